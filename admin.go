@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// UserSummary describes a user with plays.
+//
+// we identify users only by ID. we do not expose anything else about them.
+type UserSummary struct {
+	UserId     int64 `json:"user_id"`
+	TotalPlays int64 `json:"total_plays"`
+	// RFC3339.
+	LastPlay string `json:"last_play"`
+}
+
+// UsersResponse is the body we send in response to a list users request.
+type UsersResponse struct {
+	Users []UserSummary `json:"users"`
+}
+
+// retrieveUsers lists the users who have plays, those with the most plays
+// first.
+func retrieveUsers(ctx context.Context, db *sql.DB) ([]UserSummary,
+	error) {
+	defer observeQuery("users", time.Now(), "")
+
+	query := `
+SELECT
+user_id,
+COUNT(*) AS total_plays,
+MAX(create_time) AS last_play
+FROM play
+GROUP BY user_id
+ORDER BY total_plays DESC, user_id
+`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var user UserSummary
+		var lastPlay time.Time
+		err := rows.Scan(&user.UserId, &user.TotalPlays, &lastPlay)
+		if err != nil {
+			return nil, err
+		}
+		user.LastPlay = lastPlay.Format(time.RFC3339)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// handlerListUsers lists the users who have plays.
+func handlerListUsers(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	users, err := retrieveUsers(request.Context(), handler.db)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve users: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, UsersResponse{Users: users})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// dbPingTimeout is how long we wait on the database for a ping request.
+const dbPingTimeout = 3 * time.Second
+
+// DbPingResponse is the body we send in response to a database ping
+// request.
+type DbPingResponse struct {
+	// how long the ping took. only set if it succeeded.
+	PingMs *int64 `json:"ping_ms,omitempty"`
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handlerDbPing pings the database and reports how long it took. this
+// lets operators check database latency.
+func handlerDbPing(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	ctx, cancel := context.WithTimeout(request.Context(), dbPingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := handler.db.PingContext(ctx)
+	pingMs := time.Since(start).Milliseconds()
+
+	status := http.StatusOK
+	response := DbPingResponse{PingMs: &pingMs, Ok: true}
+	if err != nil {
+		logger.Printf("Database ping failed: %s", err.Error())
+		status = http.StatusServiceUnavailable
+		response = DbPingResponse{Ok: false, Error: err.Error()}
+	}
+
+	// build and send the response. it is only useful fresh.
+	rw.Header().Set("Cache-Control", "no-store")
+	err = sendJSONResponse(rw, status, response)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
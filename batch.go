@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// recordBatchPlaysMax is the most plays we accept in one record batch
+// request.
+const recordBatchPlaysMax = 1000
+
+// RecordBatchPlay is one play in a record batch request. it has the same
+// fields as a request to record a single play, less the user.
+type RecordBatchPlay struct {
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Title    string `json:"title"`
+	LengthMs int64  `json:"length_ms"`
+	// optional. 0 if unknown.
+	DiscNumber int64 `json:"disc_number"`
+	// optional. 0 if unknown.
+	TrackNumber int64 `json:"track_number"`
+	// optional. 0 if unknown.
+	Year int64 `json:"year"`
+	// optional.
+	Genre string `json:"genre"`
+}
+
+// song gives the details of the song the play is of.
+func (play *RecordBatchPlay) song() *SongDetails {
+	return &SongDetails{
+		Artist:      play.Artist,
+		Album:       play.Album,
+		Title:       play.Title,
+		LengthMs:    play.LengthMs,
+		DiscNumber:  play.DiscNumber,
+		TrackNumber: play.TrackNumber,
+		Year:        play.Year,
+		Genre:       play.Genre,
+	}
+}
+
+// RecordBatchRequest is the body of a request to record several plays.
+type RecordBatchRequest struct {
+	UserId int64             `json:"user_id"`
+	Plays  []RecordBatchPlay `json:"plays"`
+}
+
+// RecordBatchError describes a play in a record batch request that we did
+// not record.
+type RecordBatchError struct {
+	// the play's position in the request, counting from 0.
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// RecordBatchResponse is the body we send after recording several plays.
+type RecordBatchResponse struct {
+	Recorded int64 `json:"recorded"`
+	// plays we already had. see recordPlay.
+	Duplicates int64              `json:"duplicates"`
+	Errors     []RecordBatchError `json:"errors"`
+}
+
+// getParametersRecordBatch decodes and validates the body of a request to
+// record several plays. we validate the individual plays as we record
+// them.
+func getParametersRecordBatch(request *http.Request) (*RecordBatchRequest,
+	error) {
+	logger := requestLogger(request)
+
+	var params RecordBatchRequest
+	err := json.NewDecoder(request.Body).Decode(&params)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid request body: %s", err.Error())
+	}
+
+	if params.UserId < 1 {
+		return nil, errors.New("Invalid user ID")
+	}
+	if len(params.Plays) == 0 {
+		return nil, errors.New("No plays given")
+	}
+	if len(params.Plays) > recordBatchPlaysMax {
+		return nil, fmt.Errorf("Too many plays. At most %d are allowed",
+			recordBatchPlaysMax)
+	}
+	logger.Printf("Parameters: user_id [%d] plays [%d]", params.UserId,
+		len(params.Plays))
+	return &params, nil
+}
+
+// recordBatch records the valid plays in the request in a single
+// transaction. we add songs as necessary.
+//
+// invalid plays do not stop us recording the rest. we note them in the
+// response. plays that are duplicates of a play we had we count but do not
+// record. we insert the remaining plays together.
+//
+// plays of the same song within the request are all recorded. a client
+// catching up may well have played a song more than once.
+func recordBatch(ctx context.Context, db *sql.DB, params *RecordBatchRequest,
+	duplicateWindow time.Duration) (*RecordBatchResponse, error) {
+	defer observeQuery("record_batch", time.Now(),
+		fmt.Sprintf("user_id [%d] plays [%d]", params.UserId,
+			len(params.Plays)))
+
+	response := &RecordBatchResponse{Errors: []RecordBatchError{}}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var songIds []int64
+	for i := range params.Plays {
+		song := params.Plays[i].song()
+
+		err := validatePlay(song)
+		if err != nil {
+			response.Errors = append(response.Errors,
+				RecordBatchError{Index: i, Error: err.Error()})
+			continue
+		}
+
+		songId, err := retrieveOrCreateSong(ctx, tx, song)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		_, duplicate, err := retrieveDuplicatePlay(ctx, tx, params.UserId,
+			songId, duplicateWindow)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if duplicate {
+			response.Duplicates++
+			continue
+		}
+
+		songIds = append(songIds, songId)
+	}
+
+	if len(songIds) > 0 {
+		err := insertPlays(ctx, tx, params.UserId, songIds)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	response.Recorded = int64(len(songIds))
+	return response, nil
+}
+
+// insertPlays adds a play by the user of each of the songs in one
+// statement.
+func insertPlays(ctx context.Context, tx *sql.Tx, userId int64,
+	songIds []int64) error {
+	values := make([]string, 0, len(songIds))
+	args := []interface{}{userId}
+	for _, songId := range songIds {
+		args = append(args, songId)
+		values = append(values,
+			fmt.Sprintf("($1, $%d, current_timestamp)", len(args)))
+	}
+
+	query := `
+INSERT INTO play
+(user_id, song_id, create_time)
+VALUES ` + strings.Join(values, ", ")
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// handlerRecordBatch records several plays at once, such as ones a client
+// queued while it could not reach us.
+func handlerRecordBatch(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersRecordBatch(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	duplicateWindow := time.Duration(handler.settings.DuplicateWindowSeconds) *
+		time.Second
+	response, err := recordBatch(request.Context(), handler.db, params,
+		duplicateWindow)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to record plays: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	logger.Printf("Recorded [%d] plays, [%d] duplicates, [%d] errors",
+		response.Recorded, response.Duplicates, len(response.Errors))
+	if response.Recorded > 0 {
+		handler.cache.invalidateUser(params.UserId)
+	}
+
+	// build and send the response.
+	status := http.StatusCreated
+	if len(response.Errors) > 0 {
+		status = http.StatusMultiStatus
+	}
+	err = sendJSONResponse(rw, status, response)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
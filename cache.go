@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// cacheMaxEntries bounds how many results we cache.
+const cacheMaxEntries = 10000
+
+// cacheEntry is a cached set of top results.
+type cacheEntry struct {
+	// the user the results are for, so we can invalidate by user.
+	userId  int64
+	results []TopResult
+	total   int64
+	// when the entry is no longer valid.
+	expires time.Time
+}
+
+// Cache holds recent top results in memory.
+//
+// a nil *Cache is valid and caches nothing.
+type Cache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+// newCache creates a cache whose entries last for the given time. if the
+// time is zero, we do not cache.
+func newCache(ttl time.Duration) *Cache {
+	if ttl == 0 {
+		return nil
+	}
+	return &Cache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// topCacheKey builds the key for the results of a top request of the given
+// kind (e.g. artists).
+func topCacheKey(kind string, params *TopParameters) string {
+	return fmt.Sprintf("%s:%d:%d:%d:%d", kind, params.UserId, params.Limit,
+		params.Offset, params.DaysBack)
+}
+
+// get looks up results. we return whether we found valid ones.
+func (cache *Cache) get(key string) ([]TopResult, int64, bool) {
+	if cache == nil {
+		return nil, 0, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, exists := cache.entries[key]
+	if !exists {
+		return nil, 0, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return nil, 0, false
+	}
+	return entry.results, entry.total, true
+}
+
+// set stores results for the given user.
+func (cache *Cache) set(key string, userId int64, results []TopResult,
+	total int64) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := time.Now()
+
+	// make room if we need to. drop expired entries first, and if that is
+	// not enough, start over.
+	if len(cache.entries) >= cacheMaxEntries {
+		for k, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, k)
+			}
+		}
+		if len(cache.entries) >= cacheMaxEntries {
+			cache.entries = make(map[string]cacheEntry)
+		}
+	}
+
+	cache.entries[key] = cacheEntry{
+		userId:  userId,
+		results: results,
+		total:   total,
+		expires: now.Add(cache.ttl),
+	}
+}
+
+// invalidateUser drops all results for the given user. we do this when
+// their plays change.
+func (cache *Cache) invalidateUser(userId int64) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for k, entry := range cache.entries {
+		if entry.userId == userId {
+			delete(cache.entries, k)
+		}
+	}
+}
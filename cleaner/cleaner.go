@@ -3,21 +3,51 @@
  *
  * It will:
  * - Report artists that may need to be consolidated
- * - Provide a way to consolidate an artist.
+ * - Provide a way to consolidate an artist, or many artists at once.
+ * - Report albums that may need to be consolidated
+ * - Provide a way to consolidate an album.
+ * - Report songs that may need to be consolidated
+ * - Provide a way to consolidate a song.
+ * - Report artists with suspiciously many or few songs.
+ * - Merge two song rows into one.
  */
 
 package main
 
 import (
+	"bufio"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	_ "github.com/lib/pq"
 	"log"
 	"os"
+	"strings"
+	"text/tabwriter"
 )
 
+// DB is the part of *sql.DB we need to check and fix artists. we can
+// test those with a fake one.
+type DB interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Begin() (*sql.Tx, error)
+}
+
+// DuplicateArtist describes an artist that appears under several names
+// differing only by case.
+type DuplicateArtist struct {
+	LowerName string
+	Count     uint64
+}
+
+// artistFix describes renaming one artist to another.
+type artistFix struct {
+	Old string
+	New string
+}
+
 type args struct {
 	DBUser string
 	DBPass string
@@ -27,8 +57,28 @@ type args struct {
 
 	Mode string
 
+	// How to report results. 'log' or 'json'.
+	Output string
+
 	ArtistOld string
 	ArtistNew string
+	DryRun    bool
+	FixesFile string
+
+	Artist   string
+	AlbumOld string
+	AlbumNew string
+
+	TitleOld string
+	TitleNew string
+
+	// Artists with more songs than this are reported. For
+	// check-artist-songs mode.
+	SongCountThreshold uint64
+
+	// Song to merge into, and song to merge from. For merge-songs mode.
+	SongIDKeep int64
+	SongIDDrop int64
 }
 
 func main() {
@@ -52,6 +102,46 @@ func main() {
 		os.Exit(0)
 	}
 
+	if args.Mode == "check-albums" {
+		if !checkAlbums(db, args) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if args.Mode == "check-songs" {
+		if !checkSongs(db, args) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if args.Mode == "check-artist-songs" {
+		if !checkArtistSongs(db, args) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if args.Mode == "fix-artist" && args.DryRun {
+		if !dryRunFixArtist(db, args) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if args.Mode == "fix-artist" && len(args.FixesFile) > 0 {
+		fixes, err := readArtistFixes(args.FixesFile)
+		if err != nil {
+			log.Printf("Unable to read fixes file: %s", err.Error())
+			os.Exit(1)
+		}
+		if !fixArtistsBulk(db, fixes) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if args.Mode == "fix-artist" {
 		if !fixArtist(db, args) {
 			os.Exit(1)
@@ -59,6 +149,29 @@ func main() {
 		os.Exit(0)
 	}
 
+	if args.Mode == "fix-album" {
+		if !fixAlbum(db, args) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if args.Mode == "fix-song" {
+		if !fixSong(db, args) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if args.Mode == "merge-songs" {
+		err := mergeSongs(db, args.SongIDKeep, args.SongIDDrop)
+		if err != nil {
+			log.Printf("Unable to merge songs: %s", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	log.Printf("Invalid mode: %s", args.Mode)
 	os.Exit(1)
 }
@@ -70,10 +183,26 @@ func getArgs() (*args, error) {
 	host := flag.String("host", "localhost", "Database host.")
 	port := flag.Uint64("port", 5432, "Database port.")
 
-	mode := flag.String("mode", "check-artists", "Program mode. Must be one of 'check-artists' or 'fix-artist'.")
+	mode := flag.String("mode", "check-artists", "Program mode. Must be one of 'check-artists', 'check-albums', 'check-songs', 'check-artist-songs', 'fix-artist', 'fix-album', 'fix-song', or 'merge-songs'.")
+
+	output := flag.String("output", "log", "How to report results. Must be one of 'log' or 'json'. For check-artists mode.")
 
 	artistOld := flag.String("artist-old", "", "Old artist name. For fix-artist mode.")
 	artistNew := flag.String("artist-new", "", "New artist name. For fix-artist mode.")
+	fixesFile := flag.String("fixes-file", "", "Path to a file of artist fixes, one 'old|new' per line. For fix-artist mode, instead of artist old and new.")
+	dryRun := flag.Bool("dry-run", false, "Show what would change rather than changing it. For fix-artist mode.")
+
+	artist := flag.String("artist", "", "Artist name. For fix-album and fix-song modes.")
+	albumOld := flag.String("album-old", "", "Old album name. For fix-album mode.")
+	albumNew := flag.String("album-new", "", "New album name. For fix-album mode.")
+
+	titleOld := flag.String("title-old", "", "Old song title. For fix-song mode.")
+	titleNew := flag.String("title-new", "", "New song title. For fix-song mode.")
+
+	songCountThreshold := flag.Uint64("song-count-threshold", 1000, "Report artists with more songs than this. For check-artist-songs mode.")
+
+	songIDKeep := flag.Int64("song-id-keep", 0, "ID of the song to keep. For merge-songs mode.")
+	songIDDrop := flag.Int64("song-id-drop", 0, "ID of the song to merge into the kept song and then delete. For merge-songs mode.")
 
 	flag.Parse()
 
@@ -108,16 +237,74 @@ func getArgs() (*args, error) {
 	}
 
 	if *mode != "check-artists" &&
-		*mode != "fix-artist" {
+		*mode != "check-albums" &&
+		*mode != "check-songs" &&
+		*mode != "check-artist-songs" &&
+		*mode != "fix-artist" &&
+		*mode != "fix-album" &&
+		*mode != "fix-song" &&
+		*mode != "merge-songs" {
 		err := errors.New("Invalid mode.")
 		flag.PrintDefaults()
 		return nil, err
 	}
 
-	if *mode == "fix-artist" {
+	if *output != "log" &&
+		*output != "json" {
+		err := errors.New("Invalid output.")
+		flag.PrintDefaults()
+		return nil, err
+	}
+
+	if *mode == "fix-artist" && len(*fixesFile) > 0 {
+		if len(*artistOld) > 0 ||
+			len(*artistNew) > 0 ||
+			*dryRun {
+			err := errors.New("You must not provide artist old, artist new, or dry run with a fixes file.")
+			flag.PrintDefaults()
+			return nil, err
+		}
+	}
+
+	if *mode == "fix-artist" && len(*fixesFile) == 0 {
 		if len(*artistOld) == 0 ||
 			len(*artistNew) == 0 {
-			err := errors.New("You must provide artist old and new for fix-artist mode.")
+			err := errors.New("You must provide artist old and new, or a fixes file, for fix-artist mode.")
+			flag.PrintDefaults()
+			return nil, err
+		}
+	}
+
+	if *mode == "fix-album" {
+		if len(*artist) == 0 ||
+			len(*albumOld) == 0 ||
+			len(*albumNew) == 0 {
+			err := errors.New("You must provide artist, album old, and album new for fix-album mode.")
+			flag.PrintDefaults()
+			return nil, err
+		}
+	}
+
+	if *mode == "fix-song" {
+		if len(*artist) == 0 ||
+			len(*titleOld) == 0 ||
+			len(*titleNew) == 0 {
+			err := errors.New("You must provide artist, title old, and title new for fix-song mode.")
+			flag.PrintDefaults()
+			return nil, err
+		}
+	}
+
+	if *mode == "merge-songs" {
+		if *songIDKeep <= 0 ||
+			*songIDDrop <= 0 {
+			err := errors.New("You must provide song ID keep and song ID drop as positive integers for merge-songs mode.")
+			flag.PrintDefaults()
+			return nil, err
+		}
+
+		if *songIDKeep == *songIDDrop {
+			err := errors.New("Song ID keep and song ID drop must differ.")
 			flag.PrintDefaults()
 			return nil, err
 		}
@@ -130,8 +317,21 @@ func getArgs() (*args, error) {
 		DBHost:    *host,
 		DBPort:    *port,
 		Mode:      *mode,
+		Output:    *output,
 		ArtistOld: *artistOld,
 		ArtistNew: *artistNew,
+		DryRun:    *dryRun,
+		FixesFile: *fixesFile,
+		Artist:    *artist,
+		AlbumOld:  *albumOld,
+		AlbumNew:  *albumNew,
+		TitleOld:  *titleOld,
+		TitleNew:  *titleNew,
+
+		SongCountThreshold: *songCountThreshold,
+
+		SongIDKeep: *songIDKeep,
+		SongIDDrop: *songIDDrop,
 	}, nil
 }
 
@@ -146,7 +346,7 @@ func connectToDB(args *args) (*sql.DB, error) {
 	return db, nil
 }
 
-func checkArtists(db *sql.DB, args *args) bool {
+func checkArtists(db DB, args *args) bool {
 	// Find any that are that are duplicate if we treat them case
 	// insensitively.
 	// TODO: This is something we could enforce as a database constraint.
@@ -162,7 +362,9 @@ ORDER BY 1 DESC
 		log.Printf("Query error: %s", err.Error())
 		return false
 	}
+	defer rows.Close()
 
+	duplicates := []DuplicateArtist{}
 	for rows.Next() {
 		var count uint64
 		var artist string
@@ -173,33 +375,437 @@ ORDER BY 1 DESC
 		}
 
 		if count > 1 {
-			log.Printf("Possible duplicate artist: %s", artist)
+			duplicates = append(duplicates,
+				DuplicateArtist{LowerName: artist, Count: count})
 			continue
 		}
 
 		break
 	}
 
+	if args.Output == "json" {
+		b, err := json.Marshal(duplicates)
+		if err != nil {
+			log.Printf("JSON encoding error: %s", err.Error())
+			return false
+		}
+		fmt.Println(string(b))
+		return true
+	}
+
+	for _, duplicate := range duplicates {
+		log.Printf("Possible duplicate artist: %s", duplicate.LowerName)
+	}
 	return true
 }
 
-func fixArtist(db *sql.DB, args *args) bool {
+// checkAlbums reports albums that are duplicates if we treat them case
+// insensitively. we only compare albums by the same artist.
+// we return false if there are any duplicates.
+func checkAlbums(db *sql.DB, args *args) bool {
+	sql := `
+SELECT COUNT(1), artist, LOWER(album) AS album
+FROM (SELECT DISTINCT artist, album FROM song) d
+GROUP BY artist, LOWER(album)
+ORDER BY 1 DESC
+`
+
+	rows, err := db.Query(sql)
+	if err != nil {
+		log.Printf("Query error: %s", err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	duplicates := false
+	for rows.Next() {
+		var count uint64
+		var artist string
+		var album string
+		err := rows.Scan(&count, &artist, &album)
+		if err != nil {
+			log.Printf("Row scan error: %s", err.Error())
+			return false
+		}
+
+		if count > 1 {
+			log.Printf("Possible duplicate album: %s (artist %s)", album, artist)
+			duplicates = true
+			continue
+		}
+
+		break
+	}
+
+	return !duplicates
+}
+
+// checkSongs reports songs by the same artist whose titles are duplicates
+// if we treat them case insensitively.
+// we return false if there are any duplicates.
+func checkSongs(db *sql.DB, args *args) bool {
+	sql := `
+SELECT COUNT(1), LOWER(title) AS title, artist
+FROM song
+GROUP BY LOWER(title), artist
+HAVING COUNT(1) > 1
+ORDER BY 1 DESC
+`
+
+	rows, err := db.Query(sql)
+	if err != nil {
+		log.Printf("Query error: %s", err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	duplicates := false
+	for rows.Next() {
+		var count uint64
+		var title string
+		var artist string
+		err := rows.Scan(&count, &title, &artist)
+		if err != nil {
+			log.Printf("Row scan error: %s", err.Error())
+			return false
+		}
+
+		log.Printf("Possible duplicate song: %s (artist %s, %d rows)", title,
+			artist, count)
+		duplicates = true
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Row error: %s", err.Error())
+		return false
+	}
+
+	return !duplicates
+}
+
+// checkArtistSongs reports artists whose number of songs looks wrong.
+// Many songs may mean a runaway import. A single song may mean the artist
+// name has a typo.
+func checkArtistSongs(db *sql.DB, args *args) bool {
+	sql := `
+SELECT artist, COUNT(DISTINCT id) AS song_count
+FROM song
+GROUP BY artist
+ORDER BY song_count DESC, artist
+`
+
+	rows, err := db.Query(sql)
+	if err != nil {
+		log.Printf("Query error: %s", err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ARTIST\tSONGS\tREASON")
+
+	count := 0
+	for rows.Next() {
+		var artist string
+		var songCount uint64
+		err := rows.Scan(&artist, &songCount)
+		if err != nil {
+			log.Printf("Row scan error: %s", err.Error())
+			return false
+		}
+
+		reason := ""
+		if songCount > args.SongCountThreshold {
+			reason = "Many songs. Possible runaway import"
+		}
+		if songCount == 1 {
+			reason = "One song. Possible typo"
+		}
+		if reason == "" {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\n", artist, songCount, reason)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Row error: %s", err.Error())
+		return false
+	}
+
+	err = w.Flush()
+	if err != nil {
+		log.Printf("Output error: %s", err.Error())
+		return false
+	}
+
+	log.Printf("Found %d artists to check", count)
+	return true
+}
+
+func fixArtist(db DB, args *args) bool {
 	var sql string = `
 UPDATE song SET artist = $1 WHERE LOWER(artist) = LOWER($2) AND artist <> $3
 `
 
-	result, err := db.Exec(sql, args.ArtistNew, args.ArtistOld, args.ArtistNew)
+	rowsAffected, err := execUpdate(db, sql, args.ArtistNew, args.ArtistOld,
+		args.ArtistNew)
 	if err != nil {
 		log.Printf("SQL failure: %s", err.Error())
 		return false
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	if rowsAffected == 0 {
+		log.Printf("Warning: No rows matched artist %s", args.ArtistOld)
+		return true
+	}
+
+	log.Printf("Updated %d rows to artist %s", rowsAffected, args.ArtistNew)
+	return true
+}
+
+// execUpdate runs the given update statement in a transaction. we only
+// commit if it changed something.
+// we return how many rows were changed.
+func execUpdate(db DB, sql string, params ...interface{}) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := execUpdateTx(tx, sql, params...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if rowsAffected == 0 {
+		return 0, tx.Rollback()
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected, nil
+}
+
+// execUpdateTx runs the given update statement in the transaction and
+// returns how many rows it changed.
+func execUpdateTx(tx *sql.Tx, sql string, params ...interface{}) (int64,
+	error) {
+	result, err := tx.Exec(sql, params...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// readArtistFixes reads a file of artist fixes. each line is of the form
+// old|new. lines starting with # are comments.
+func readArtistFixes(path string) ([]artistFix, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var fixes []artistFix
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pieces := strings.SplitN(line, "|", 2)
+		if len(pieces) != 2 {
+			return nil, fmt.Errorf("Invalid line: %s", line)
+		}
+
+		fix := artistFix{
+			Old: strings.TrimSpace(pieces[0]),
+			New: strings.TrimSpace(pieces[1]),
+		}
+		if len(fix.Old) == 0 || len(fix.New) == 0 {
+			return nil, fmt.Errorf("Invalid line: %s", line)
+		}
+		fixes = append(fixes, fix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(fixes) == 0 {
+		return nil, errors.New("No fixes found")
+	}
+	return fixes, nil
+}
+
+// fixArtistsBulk applies each of the fixes in a single transaction. either
+// they all succeed or none do.
+func fixArtistsBulk(db *sql.DB, fixes []artistFix) bool {
+	var sql string = `
+UPDATE song SET artist = $1 WHERE LOWER(artist) = LOWER($2) AND artist <> $3
+`
+
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Rows affected failure: %s", err.Error())
+		log.Printf("SQL failure: %s", err.Error())
 		return false
 	}
 
-	log.Printf("Updated %d rows to artist %s", rowsAffected, args.ArtistNew)
+	var total int64
+	for _, fix := range fixes {
+		rowsAffected, err := execUpdateTx(tx, sql, fix.New, fix.Old, fix.New)
+		if err != nil {
+			log.Printf("SQL failure fixing artist %s: %s", fix.Old, err.Error())
+			tx.Rollback()
+			return false
+		}
+
+		if rowsAffected == 0 {
+			log.Printf("Warning: No rows matched artist %s", fix.Old)
+			continue
+		}
+		log.Printf("Updating %d rows to artist %s", rowsAffected, fix.New)
+		total += rowsAffected
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("SQL failure: %s", err.Error())
+		return false
+	}
+
+	log.Printf("Updated %d rows for %d fixes", total, len(fixes))
+	return true
+}
+
+// dryRunFixArtist shows the songs fixArtist would update, without
+// changing anything.
+func dryRunFixArtist(db *sql.DB, args *args) bool {
+	var sql string = `
+SELECT artist, title FROM song WHERE LOWER(artist) = LOWER($1) AND artist <> $2
+ORDER BY artist, title
+`
+
+	rows, err := db.Query(sql, args.ArtistOld, args.ArtistNew)
+	if err != nil {
+		log.Printf("Query error: %s", err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ARTIST\tTITLE\tNEW ARTIST")
+
+	count := 0
+	for rows.Next() {
+		var artist string
+		var title string
+		err := rows.Scan(&artist, &title)
+		if err != nil {
+			log.Printf("Row scan error: %s", err.Error())
+			return false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", artist, title, args.ArtistNew)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Row error: %s", err.Error())
+		return false
+	}
+
+	err = w.Flush()
+	if err != nil {
+		log.Printf("Output error: %s", err.Error())
+		return false
+	}
+
+	log.Printf("Would update %d rows to artist %s", count, args.ArtistNew)
+	return true
+}
+
+func fixAlbum(db *sql.DB, args *args) bool {
+	var sql string = `
+UPDATE song SET album = $1
+WHERE LOWER(album) = LOWER($2) AND artist = $3 AND album <> $1
+`
+
+	rowsAffected, err := execUpdate(db, sql, args.AlbumNew, args.AlbumOld,
+		args.Artist)
+	if err != nil {
+		log.Printf("SQL failure: %s", err.Error())
+		return false
+	}
+
+	if rowsAffected == 0 {
+		log.Printf("Warning: No rows matched album %s (artist %s)", args.AlbumOld,
+			args.Artist)
+		return true
+	}
+
+	log.Printf("Updated %d rows to album %s (artist %s)", rowsAffected,
+		args.AlbumNew, args.Artist)
+	return true
+}
+
+func fixSong(db *sql.DB, args *args) bool {
+	var sql string = `
+UPDATE song SET title = $1
+WHERE LOWER(title) = LOWER($2) AND artist = $3 AND title <> $1
+`
+
+	rowsAffected, err := execUpdate(db, sql, args.TitleNew, args.TitleOld,
+		args.Artist)
+	if err != nil {
+		log.Printf("SQL failure: %s", err.Error())
+		return false
+	}
+
+	if rowsAffected == 0 {
+		log.Printf("Warning: No rows matched title %s (artist %s)", args.TitleOld,
+			args.Artist)
+		return true
+	}
+
+	log.Printf("Updated %d rows to title %s (artist %s)", rowsAffected,
+		args.TitleNew, args.Artist)
 	return true
 }
+
+// mergeSongs moves all plays of the drop song to the keep song and then
+// deletes the drop song. It does this in a single transaction.
+func mergeSongs(db *sql.DB, keepID, dropID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	plays, err := execUpdateTx(tx,
+		`UPDATE play SET song_id = $1 WHERE song_id = $2`, keepID, dropID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to move plays: %s", err)
+	}
+
+	songs, err := execUpdateTx(tx, `DELETE FROM song WHERE id = $1`, dropID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to delete song: %s", err)
+	}
+
+	if songs == 0 {
+		tx.Rollback()
+		return fmt.Errorf("song %d not found", dropID)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Moved %d plays from song %d to song %d and deleted song %d",
+		plays, dropID, keepID, dropID)
+	return nil
+}
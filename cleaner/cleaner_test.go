@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// fakeConnector is a database/sql connector whose queries all return the
+// same rows, and whose execs all change the same number of rows. we need
+// it because only database/sql can make *sql.Rows and *sql.Tx.
+type fakeConnector struct {
+	columns []string
+	rows    [][]driver.Value
+	err     error
+
+	rowsAffected int64
+	execErr      error
+
+	// the arguments to each exec.
+	execArgs [][]driver.Value
+	// how many transactions were committed and rolled back.
+	commits   int
+	rollbacks int
+}
+
+// Connect is part of the driver.Connector interface
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{connector: c}, nil
+}
+
+// Driver is part of the driver.Connector interface
+func (c *fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+// fakeConn is a connection from a fakeConnector.
+type fakeConn struct {
+	connector *fakeConnector
+}
+
+// Prepare is part of the driver.Conn interface
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{connector: c.connector}, nil
+}
+
+// Close is part of the driver.Conn interface
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// Begin is part of the driver.Conn interface
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return &fakeTx{connector: c.connector}, nil
+}
+
+// fakeTx is a transaction on a fakeConn. we only count how it ends.
+type fakeTx struct {
+	connector *fakeConnector
+}
+
+// Commit is part of the driver.Tx interface
+func (t *fakeTx) Commit() error {
+	t.connector.commits++
+	return nil
+}
+
+// Rollback is part of the driver.Tx interface
+func (t *fakeTx) Rollback() error {
+	t.connector.rollbacks++
+	return nil
+}
+
+// fakeStmt is a statement on a fakeConn.
+type fakeStmt struct {
+	connector *fakeConnector
+}
+
+// Close is part of the driver.Stmt interface
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+// NumInput is part of the driver.Stmt interface
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+// Exec is part of the driver.Stmt interface
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.connector.execArgs = append(s.connector.execArgs, args)
+	if s.connector.execErr != nil {
+		return nil, s.connector.execErr
+	}
+	return driver.RowsAffected(s.connector.rowsAffected), nil
+}
+
+// Query is part of the driver.Stmt interface
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.connector.err != nil {
+		return nil, s.connector.err
+	}
+	return &fakeRows{connector: s.connector}, nil
+}
+
+// fakeRows are the rows of a fakeStmt query.
+type fakeRows struct {
+	connector *fakeConnector
+	i         int
+}
+
+// Columns is part of the driver.Rows interface
+func (r *fakeRows) Columns() []string {
+	return r.connector.columns
+}
+
+// Close is part of the driver.Rows interface
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+// Next is part of the driver.Rows interface
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.connector.rows) {
+		return io.EOF
+	}
+	copy(dest, r.connector.rows[r.i])
+	r.i++
+	return nil
+}
+
+// fakeDuplicateDB is a DB whose queries return artists as the check
+// artists query does.
+type fakeDuplicateDB struct {
+	*sql.DB
+	connector *fakeConnector
+}
+
+// newFakeDuplicateDB makes a fakeDuplicateDB whose queries return the
+// given counts and lowercased artists, or fail with the given error.
+func newFakeDuplicateDB(t *testing.T, rows [][]driver.Value,
+	queryErr error) *fakeDuplicateDB {
+	connector := &fakeConnector{
+		columns: []string{"count", "artist"},
+		rows:    rows,
+		err:     queryErr,
+	}
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() { db.Close() })
+	return &fakeDuplicateDB{DB: db, connector: connector}
+}
+
+// captureStdout runs fn and returns what it wrote to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unable to make pipe: %s", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+
+	w.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unable to read output: %s", err)
+	}
+	return string(b)
+}
+
+func TestCheckArtists(t *testing.T) {
+	db := newFakeDuplicateDB(t, [][]driver.Value{
+		{int64(3), "abba"},
+		{int64(2), "the cure"},
+		{int64(1), "pulp"},
+		{int64(2), "after a count of 1"},
+	}, nil)
+
+	var ok bool
+	output := captureStdout(t, func() {
+		ok = checkArtists(db, &args{Output: "json"})
+	})
+	if !ok {
+		t.Fatalf("checkArtists failed")
+	}
+
+	var duplicates []DuplicateArtist
+	err := json.Unmarshal([]byte(output), &duplicates)
+	if err != nil {
+		t.Fatalf("invalid JSON: %s: %s", err, output)
+	}
+
+	// rows are sorted by count, so we stop at the first that is not a
+	// duplicate.
+	want := []DuplicateArtist{
+		{LowerName: "abba", Count: 3},
+		{LowerName: "the cure", Count: 2},
+	}
+	if !reflect.DeepEqual(duplicates, want) {
+		t.Errorf("got %+v, wanted %+v", duplicates, want)
+	}
+}
+
+func TestCheckArtistsNoDuplicates(t *testing.T) {
+	db := newFakeDuplicateDB(t, [][]driver.Value{
+		{int64(1), "pulp"},
+	}, nil)
+
+	var ok bool
+	output := captureStdout(t, func() {
+		ok = checkArtists(db, &args{Output: "json"})
+	})
+	if !ok {
+		t.Fatalf("checkArtists failed")
+	}
+	if output != "[]\n" {
+		t.Errorf("got %q, wanted an empty list", output)
+	}
+}
+
+func TestCheckArtistsQueryError(t *testing.T) {
+	db := newFakeDuplicateDB(t, nil, errors.New("connection lost"))
+
+	if checkArtists(db, &args{Output: "log"}) {
+		t.Errorf("checkArtists succeeded, wanted failure")
+	}
+}
+
+func TestCheckArtistsScanError(t *testing.T) {
+	db := newFakeDuplicateDB(t, [][]driver.Value{
+		{"not a count", "abba"},
+	}, nil)
+
+	if checkArtists(db, &args{Output: "log"}) {
+		t.Errorf("checkArtists succeeded, wanted failure")
+	}
+}
+
+func TestFixArtist(t *testing.T) {
+	// we commit only if the update changed something.
+	tests := []struct {
+		name          string
+		rowsAffected  int64
+		execErr       error
+		want          bool
+		wantCommits   int
+		wantRollbacks int
+	}{
+		{name: "updated", rowsAffected: 3, want: true, wantCommits: 1},
+		{name: "no match", rowsAffected: 0, want: true, wantRollbacks: 1},
+		{name: "error", execErr: errors.New("connection lost"), want: false,
+			wantRollbacks: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newFakeDuplicateDB(t, nil, nil)
+			db.connector.rowsAffected = test.rowsAffected
+			db.connector.execErr = test.execErr
+
+			ok := fixArtist(db, &args{ArtistOld: "abba", ArtistNew: "ABBA"})
+			if ok != test.want {
+				t.Errorf("got %t, wanted %t", ok, test.want)
+			}
+
+			wantArgs := [][]driver.Value{{"ABBA", "abba", "ABBA"}}
+			if !reflect.DeepEqual(db.connector.execArgs, wantArgs) {
+				t.Errorf("got exec args %v, wanted %v", db.connector.execArgs,
+					wantArgs)
+			}
+			if db.connector.commits != test.wantCommits ||
+				db.connector.rollbacks != test.wantRollbacks {
+				t.Errorf("got %d commits and %d rollbacks, wanted %d and %d",
+					db.connector.commits, db.connector.rollbacks, test.wantCommits,
+					test.wantRollbacks)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package client
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -10,30 +12,146 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/horgh/taglib"
 )
 
 // hold configuration
+//
+// a configuration file is either TOML (if its name ends with .toml), or
+// lines of key = value. the keys are the same in both.
+// in the key = value format, text after a # is a comment. values may be
+// surrounded by double quotes, in which case they may contain # and \"
+// for a literal double quote.
+//
+// required keys: username, password, url, debug. username, password, and
+// url are not required if we only submit to ListenBrainz.
+//
+// optional keys:
+//
+//   - submit_target: where to record plays. song_tracker, listenbrainz, or
+//     both. defaults to song_tracker.
+//   - listenbrainz_token: the user token to submit to ListenBrainz with.
+//     required if submit_target is listenbrainz or both.
+//   - timeout_seconds: how long to wait for the server to respond to a
+//     request before giving up. defaults to 10. 0 means use the default.
+//   - tls_verify: whether to check the server's certificate. true or
+//     false. defaults to true.
+//   - max_retries, retry_base_delay_ms: see below
 type Config struct {
-	Username string
-	Password string
+	Username string `toml:"username"`
+	Password string `toml:"password"`
 	// to api.php
-	URL   string
-	Debug string
+	URL   string `toml:"url"`
+	Debug string `toml:"debug"`
+	// how long to wait for a response to a request. optional.
+	TimeoutSeconds int `toml:"timeout_seconds"`
+	// whether to verify the server's TLS certificate. optional.
+	TLSVerify bool `toml:"tls_verify"`
+	// how many times to retry recording a play if it fails. optional.
+	MaxRetries int `toml:"max_retries"`
+	// how long to wait before the first retry. we double this after each
+	// attempt. optional.
+	RetryBaseDelayMs int `toml:"retry_base_delay_ms"`
+	// where to record plays. optional.
+	SubmitTarget string `toml:"submit_target"`
+	// for submitting to ListenBrainz.
+	ListenBrainzToken string `toml:"listenbrainz_token"`
 }
 
+// defaults for optional configuration
+const (
+	defaultTimeoutSeconds   = 10
+	defaultMaxRetries       = 3
+	defaultRetryBaseDelayMs = 500
+	defaultSubmitTarget     = submitTargetSongTracker
+)
+
+// where we can record plays
+const (
+	submitTargetSongTracker  = "song_tracker"
+	submitTargetListenBrainz = "listenbrainz"
+	submitTargetBoth         = "both"
+)
+
+// where we submit listens to ListenBrainz
+const listenBrainzURL = "https://api.listenbrainz.org/1/submit-listens"
+
+// the longest we wait between attempts to record a play
+const maxRetryDelay = 30 * time.Second
+
 // hold metadata/tags from audio file
 type Tags struct {
 	Artist        string
 	Album         string
 	Title         string
 	LengthSeconds int
+	// 0 if unknown. taglib does not tell us the disc number, so we do not
+	// know it for files we read.
+	DiscNumber int
+	// 0 if unknown
+	TrackNumber int
+	// the year the song was released. 0 if unknown
+	Year int
+	// empty if unknown
+	Genre string
 }
 
 // parse a song tracker configuration
 func ParseConfig(config string) (*Config, error) {
+	var cfg *Config
+	var err error
+	if strings.EqualFold(filepath.Ext(config), ".toml") {
+		cfg, err = parseTOMLConfig(config)
+	} else {
+		cfg, err = parseKeyValueConfig(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// the configuration before we read a file. optional keys have their
+// defaults.
+func defaultConfig() *Config {
+	return &Config{
+		TLSVerify:        true,
+		MaxRetries:       defaultMaxRetries,
+		RetryBaseDelayMs: defaultRetryBaseDelayMs,
+		SubmitTarget:     defaultSubmitTarget,
+	}
+}
+
+// parse a TOML configuration file
+func parseTOMLConfig(config string) (*Config, error) {
+	cfg := defaultConfig()
+	md, err := toml.DecodeFile(config, cfg)
+	if err != nil {
+		log.Printf("Unable to parse: %s: %s", config, err.Error())
+		return nil, err
+	}
+
+	undecoded := md.Undecoded()
+	if len(undecoded) > 0 {
+		log.Printf("Unknown config key: %s", undecoded[0].String())
+		return nil, fmt.Errorf("Unknown config key: %s", undecoded[0].String())
+	}
+	return cfg, nil
+}
+
+// parse a configuration file made of key = value lines
+func parseKeyValueConfig(config string) (*Config, error) {
 	fd, err := os.Open(config)
 	if err != nil {
 		log.Printf("Unable to open: %s: %s", config, err.Error())
@@ -41,11 +159,7 @@ func ParseConfig(config string) (*Config, error) {
 	}
 	defer fd.Close()
 
-	// options we parse out
-	username := ""
-	password := ""
-	url := ""
-	debug := ""
+	cfg := defaultConfig()
 
 	scanner := bufio.NewScanner(fd)
 	for scanner.Scan() {
@@ -58,33 +172,76 @@ func ParseConfig(config string) (*Config, error) {
 			continue
 		}
 
-		pieces := strings.Split(line, "=")
+		// split on the first = only. values may contain them.
+		pieces := strings.SplitN(line, "=", 2)
 		if len(pieces) != 2 {
 			log.Printf("Invalid line: %s", line)
 			return nil, fmt.Errorf("Invalid configuration line: %s", line)
 		}
 
 		key := strings.TrimSpace(pieces[0])
-		value := strings.TrimSpace(pieces[1])
+		value, err := parseValue(pieces[1])
+		if err != nil {
+			log.Printf("Invalid line: %s: %s", line, err.Error())
+			return nil, fmt.Errorf("Invalid configuration line: %s: %s", line,
+				err.Error())
+		}
 		if len(key) == 0 || len(value) == 0 {
 			log.Printf("Key/value is blank: %s", line)
 			return nil, fmt.Errorf("Key/value is blank: %s", line)
 		}
 
 		if key == "username" {
-			username = value
+			cfg.Username = value
 			continue
 		}
 		if key == "password" {
-			password = value
+			cfg.Password = value
 			continue
 		}
 		if key == "url" {
-			url = value
+			cfg.URL = value
 			continue
 		}
 		if key == "debug" {
-			debug = value
+			cfg.Debug = value
+			continue
+		}
+		if key == "timeout_seconds" {
+			cfg.TimeoutSeconds, err = parseNonNegativeInt(key, value)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if key == "tls_verify" {
+			if value != "true" && value != "false" {
+				log.Printf("Invalid value for %s: %s", key, value)
+				return nil, fmt.Errorf("Invalid value for %s: %s", key, value)
+			}
+			cfg.TLSVerify = value == "true"
+			continue
+		}
+		if key == "max_retries" {
+			cfg.MaxRetries, err = parseNonNegativeInt(key, value)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if key == "retry_base_delay_ms" {
+			cfg.RetryBaseDelayMs, err = parseNonNegativeInt(key, value)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if key == "submit_target" {
+			cfg.SubmitTarget = value
+			continue
+		}
+		if key == "listenbrainz_token" {
+			cfg.ListenBrainzToken = value
 			continue
 		}
 		log.Printf("Unknown config key: %s", key)
@@ -94,18 +251,104 @@ func ParseConfig(config string) (*Config, error) {
 		log.Printf("Reading error: %s", err.Error())
 		return nil, err
 	}
+	return cfg, nil
+}
+
+// parse the value part of a key = value line. we strip any trailing
+// comment, and if the value is quoted, the quotes.
+func parseValue(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
 
-	if username == "" || password == "" || url == "" || debug == "" {
-		log.Printf("Missing required configuration key")
-		return nil, errors.New("Missing required configuration key")
+	if !strings.HasPrefix(raw, "\"") {
+		if i := strings.Index(raw, "#"); i != -1 {
+			raw = raw[:i]
+		}
+		return strings.TrimSpace(raw), nil
 	}
 
-	return &Config{
-		Username: username,
-		Password: password,
-		URL:      url,
-		Debug:    debug,
-	}, nil
+	var value strings.Builder
+	for i := 1; i < len(raw); i++ {
+		c := raw[i]
+		if c == '\\' && i+1 < len(raw) &&
+			(raw[i+1] == '"' || raw[i+1] == '\\') {
+			value.WriteByte(raw[i+1])
+			i++
+			continue
+		}
+		if c == '"' {
+			// only a comment may follow the closing quote.
+			rest := strings.TrimSpace(raw[i+1:])
+			if len(rest) > 0 && !strings.HasPrefix(rest, "#") {
+				return "", errors.New("unexpected text after quoted value")
+			}
+			return value.String(), nil
+		}
+		value.WriteByte(c)
+	}
+	return "", errors.New("unterminated quoted value")
+}
+
+// check a parsed configuration is complete and valid, and fill in any
+// defaults that depend on what was set
+func checkConfig(cfg *Config) error {
+	if cfg.SubmitTarget != submitTargetSongTracker &&
+		cfg.SubmitTarget != submitTargetListenBrainz &&
+		cfg.SubmitTarget != submitTargetBoth {
+		return fmt.Errorf("Invalid value for submit_target: %s",
+			cfg.SubmitTarget)
+	}
+
+	var missing []string
+	if cfg.SubmitTarget != submitTargetListenBrainz {
+		if cfg.Username == "" {
+			missing = append(missing, "username")
+		}
+		if cfg.Password == "" {
+			missing = append(missing, "password")
+		}
+		if cfg.URL == "" {
+			missing = append(missing, "url")
+		}
+	}
+	if cfg.SubmitTarget != submitTargetSongTracker &&
+		cfg.ListenBrainzToken == "" {
+		missing = append(missing, "listenbrainz_token")
+	}
+	if cfg.Debug == "" {
+		missing = append(missing, "debug")
+	}
+	if len(missing) > 0 {
+		log.Printf("Missing required config keys: %s", strings.Join(missing, ", "))
+		return fmt.Errorf("missing required config keys: %s",
+			strings.Join(missing, ", "))
+	}
+
+	if cfg.TimeoutSeconds < 0 {
+		return fmt.Errorf("Invalid value for timeout_seconds: %d",
+			cfg.TimeoutSeconds)
+	}
+	if cfg.MaxRetries < 0 {
+		return fmt.Errorf("Invalid value for max_retries: %d", cfg.MaxRetries)
+	}
+	if cfg.RetryBaseDelayMs < 0 {
+		return fmt.Errorf("Invalid value for retry_base_delay_ms: %d",
+			cfg.RetryBaseDelayMs)
+	}
+
+	if cfg.TimeoutSeconds == 0 {
+		cfg.TimeoutSeconds = defaultTimeoutSeconds
+	}
+	return nil
+}
+
+// parse an integer config value that must not be negative
+func parseNonNegativeInt(key string, value string) (int, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		log.Printf("Invalid value for %s: %s", key, value)
+		return 0, fmt.Errorf("Invalid value for %s: %s", key, value)
+	}
+	return i, nil
 }
 
 // extract tags from an audio file
@@ -125,11 +368,67 @@ func ExtractTags(file string) (*Tags, error) {
 		Album:         tags.Album,
 		Title:         tags.Title,
 		LengthSeconds: properties.LengthSeconds,
+		TrackNumber:   tags.Track,
+		Year:          tags.Year,
+		Genre:         tags.Genre,
 	}, nil
 }
 
-// send API request to record a play
+// the targets (song_tracker, listenbrainz) the config says to submit plays
+// to
+func (config *Config) Targets() []string {
+	switch config.SubmitTarget {
+	case submitTargetListenBrainz:
+		return []string{submitTargetListenBrainz}
+	case submitTargetBoth:
+		return []string{submitTargetSongTracker, submitTargetListenBrainz}
+	default:
+		return []string{submitTargetSongTracker}
+	}
+}
+
+// record a play happening now to each of the configured submit targets.
+// a failure to any is an error.
 func RecordPlay(config *Config, tags *Tags) error {
+	_, err := RecordPlayAt(config, tags, time.Now(), config.Targets())
+	return err
+}
+
+// record a play made at the given time to each of the given targets (see
+// Targets()). we try every target even if one fails. if any fail, we
+// return the ones that did along with an error, so the caller can retry
+// only those.
+//
+// the song tracker records plays at the time it receives them, so the time
+// only reaches ListenBrainz.
+func RecordPlayAt(config *Config, tags *Tags, playedAt time.Time,
+	targets []string) ([]string, error) {
+	var failed []string
+	var msgs []string
+	for _, target := range targets {
+		var err error
+		switch target {
+		case submitTargetSongTracker:
+			err = recordPlaySongTracker(config, tags)
+		case submitTargetListenBrainz:
+			err = RecordPlayListenBrainz(config, tags, playedAt)
+		default:
+			err = fmt.Errorf("unknown submit target: %s", target)
+		}
+		if err != nil {
+			log.Printf("Failed to record play to %s: %s", target, err.Error())
+			failed = append(failed, target)
+			msgs = append(msgs, fmt.Sprintf("%s: %s", target, err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		return failed, errors.New(strings.Join(msgs, ". "))
+	}
+	return nil, nil
+}
+
+// send API request to record a play to the song tracker
+func recordPlaySongTracker(config *Config, tags *Tags) error {
 	log.Printf("Recording Artist [%s] Album [%s] Title [%s] Seconds [%d]",
 		tags.Artist, tags.Album, tags.Title, tags.LengthSeconds)
 
@@ -143,47 +442,250 @@ func RecordPlay(config *Config, tags *Tags) error {
 	v.Set("album", tags.Album)
 	v.Set("title", tags.Title)
 	v.Set("length", fmt.Sprintf("%d", lengthMilliseconds))
+	if tags.DiscNumber > 0 {
+		v.Set("disc", fmt.Sprintf("%d", tags.DiscNumber))
+	}
+	if tags.TrackNumber > 0 {
+		v.Set("track", fmt.Sprintf("%d", tags.TrackNumber))
+	}
+	if tags.Year > 0 {
+		v.Set("year", fmt.Sprintf("%d", tags.Year))
+	}
+	if tags.Genre != "" {
+		v.Set("genre", tags.Genre)
+	}
 
-	// NOTE: we set up a http.Transport to use TLS settings (we do not want
-	//   to check certificates because my site does not have a valid one
-	//   right now), and then set the transport on the http.Client, and then
-	//   make the request.
+	httpClient := newHTTPClient(config)
+
+	return withRetries(config, "record play", func() (bool, error) {
+		return postPlay(httpClient, config.URL, v)
+	})
+}
+
+// build the client we make requests with.
+func newHTTPClient(config *Config) *http.Client {
+	// NOTE: we set up a http.Transport to use TLS settings (certificate
+	//   checking can be turned off for sites without a valid one), and then
+	//   set the transport on the http.Client, and then make the request.
 	//   we have to do it in this round about way rather than simply
 	//   http.Get() or the like in order to pass through the TLS setting it
 	//   appears.
 	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+		InsecureSkipVerify: !config.TLSVerify,
 	}
 	httpTransport := &http.Transport{
 		TLSClientConfig: tlsConfig,
 	}
-	httpClient := &http.Client{
+	return &http.Client{
 		Transport: httpTransport,
+		Timeout:   time.Duration(config.TimeoutSeconds) * time.Second,
+	}
+}
+
+// make an attempt, retrying it as configured. the attempt says whether it
+// is worth retrying if it fails. what describes the attempt in errors.
+func withRetries(config *Config, what string,
+	attemptFunc func() (bool, error)) error {
+	var lastErr error
+	for attempt := 0; attempt <= config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(config.RetryBaseDelayMs, attempt-1)
+			log.Printf("Retrying in %s (attempt %d of %d)", delay, attempt+1,
+				config.MaxRetries+1)
+			time.Sleep(delay)
+		}
+
+		retryable, err := attemptFunc()
+		if err == nil {
+			return nil
+		}
+		log.Printf("Attempt %d failed: %s", attempt+1, err.Error())
+		lastErr = err
+
+		if !retryable {
+			return fmt.Errorf("Failed to %s after %d attempt(s): %w", what,
+				attempt+1, err)
+		}
 	}
 
-	httpResponse, err := httpClient.PostForm(config.URL, v)
+	return fmt.Errorf("Failed to %s after %d attempt(s): %w", what,
+		config.MaxRetries+1, lastErr)
+}
+
+// make a HEAD request to the song tracker URL to check we can reach it.
+// any response short of a server error means we can. we return the status
+// code.
+func CheckURL(config *Config) (int, error) {
+	httpClient := newHTTPClient(config)
+
+	httpResponse, err := httpClient.Head(config.URL)
+	if err != nil {
+		return 0, err
+	}
+	httpResponse.Body.Close()
+
+	if httpResponse.StatusCode >= 500 {
+		return httpResponse.StatusCode,
+			fmt.Errorf("HTTP code %d", httpResponse.StatusCode)
+	}
+	return httpResponse.StatusCode, nil
+}
+
+// how long to wait before the retry following the given attempt. attempts
+// count from 0.
+func retryDelay(baseDelayMs int, attempt int) time.Duration {
+	delay := time.Duration(baseDelayMs) * time.Millisecond
+	for i := 0; i < attempt; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// make a single request to record a play. we say whether it is worth
+// retrying if it fails: network errors and server errors are, client
+// errors are not.
+func postPlay(httpClient *http.Client, apiURL string, v url.Values) (bool,
+	error) {
+	httpResponse, err := httpClient.PostForm(apiURL, v)
 	if err != nil {
 		log.Print("HTTP POST failure")
 		// it appears we do not need to call Body.Close() here - if we try
 		// then we get a runtime error about nil pointer dereference.
-		return err
+		return true, err
 	}
 
 	body, err := ioutil.ReadAll(httpResponse.Body)
 	httpResponse.Body.Close()
 	if err != nil {
 		log.Print("Failed to read response body: " + err.Error())
-		return err
+		return true, err
 	}
 	log.Printf("Response body: %s", body)
 
 	if httpResponse.StatusCode != 200 {
 		log.Printf("HTTP response is not 200")
-		return fmt.Errorf("HTTP code %d", httpResponse.StatusCode)
+		return httpResponse.StatusCode >= 500,
+			fmt.Errorf("HTTP code %d", httpResponse.StatusCode)
 	}
 
 	log.Printf("Play recorded!")
-	return nil
+	return false, nil
+}
+
+// a ListenBrainz submit-listens request body
+type listenBrainzSubmission struct {
+	ListenType string               `json:"listen_type"`
+	Payload    []listenBrainzListen `json:"payload"`
+}
+
+// one listen in a ListenBrainz submission
+type listenBrainzListen struct {
+	// unix seconds
+	ListenedAt    int64                     `json:"listened_at"`
+	TrackMetadata listenBrainzTrackMetadata `json:"track_metadata"`
+}
+
+// what we tell ListenBrainz about a track
+type listenBrainzTrackMetadata struct {
+	ArtistName     string                     `json:"artist_name"`
+	TrackName      string                     `json:"track_name"`
+	ReleaseName    string                     `json:"release_name,omitempty"`
+	AdditionalInfo listenBrainzAdditionalInfo `json:"additional_info"`
+}
+
+// optional information about a track
+type listenBrainzAdditionalInfo struct {
+	DurationMs int `json:"duration_ms,omitempty"`
+}
+
+// send API request to submit a listen of a song, made at the given time,
+// to ListenBrainz
+func RecordPlayListenBrainz(config *Config, tags *Tags,
+	listenedAt time.Time) error {
+	log.Printf("Submitting to ListenBrainz Artist [%s] Album [%s] Title [%s] Seconds [%d]",
+		tags.Artist, tags.Album, tags.Title, tags.LengthSeconds)
+
+	submission := listenBrainzSubmission{
+		ListenType: "single",
+		Payload: []listenBrainzListen{
+			{
+				ListenedAt: listenedAt.Unix(),
+				TrackMetadata: listenBrainzTrackMetadata{
+					ArtistName:  tags.Artist,
+					TrackName:   tags.Title,
+					ReleaseName: tags.Album,
+					AdditionalInfo: listenBrainzAdditionalInfo{
+						DurationMs: tags.LengthSeconds * 1000,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return err
+	}
+
+	httpClient := newHTTPClient(config)
+
+	return withRetries(config, "submit listen", func() (bool, error) {
+		return postListen(httpClient, config.ListenBrainzToken, body)
+	})
+}
+
+// make a single request to submit a listen to ListenBrainz. as with
+// postPlay we say whether it is worth retrying. ListenBrainz tells us to
+// slow down with a 429, so we retry those too.
+func postListen(httpClient *http.Client, token string, body []byte) (bool,
+	error) {
+	request, err := http.NewRequest(http.MethodPost, listenBrainzURL,
+		bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Authorization", "Token "+token)
+	request.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := httpClient.Do(request)
+	if err != nil {
+		log.Print("HTTP POST failure")
+		return true, err
+	}
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	httpResponse.Body.Close()
+	if err != nil {
+		log.Print("Failed to read response body: " + err.Error())
+		return true, err
+	}
+	log.Printf("Response body: %s", responseBody)
+
+	if httpResponse.StatusCode != 200 {
+		log.Printf("HTTP response is not 200")
+		return httpResponse.StatusCode >= 500 ||
+				httpResponse.StatusCode == http.StatusTooManyRequests,
+			fmt.Errorf("HTTP code %d", httpResponse.StatusCode)
+	}
+
+	log.Printf("Listen submitted!")
+	return false, nil
+}
+
+// RecordPlays records each of the given plays. we carry on if any fail.
+// we return an error for each play, in the same order. the error is nil
+// if the play was recorded.
+func RecordPlays(config *Config, tags []*Tags) []error {
+	errs := make([]error, len(tags))
+	for i, t := range tags {
+		errs[i] = RecordPlay(config, t)
+	}
+	return errs
 }
 
 // ExtractAndRecord parses the configuration, extracts metadata,
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig writes a temporary config file with the given contents. we
+// return its path.
+func writeConfig(t *testing.T, contents string) string {
+	fh, err := os.CreateTemp(t.TempDir(), "config-*.conf")
+	if err != nil {
+		t.Fatalf("unable to create config: %s", err)
+	}
+	_, err = fh.WriteString(contents)
+	if err != nil {
+		fh.Close()
+		t.Fatalf("unable to write config: %s", err)
+	}
+	err = fh.Close()
+	if err != nil {
+		t.Fatalf("unable to close config: %s", err)
+	}
+	return fh.Name()
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+		want     *Config
+	}{
+		{
+			name: "valid",
+			contents: `# a comment
+username = cd
+password = mypass
+url = https://example.com/api.php
+debug = 1
+`,
+			want: &Config{
+				Username:         "cd",
+				Password:         "mypass",
+				URL:              "https://example.com/api.php",
+				Debug:            "1",
+				TimeoutSeconds:   defaultTimeoutSeconds,
+				TLSVerify:        true,
+				MaxRetries:       defaultMaxRetries,
+				RetryBaseDelayMs: defaultRetryBaseDelayMs,
+				SubmitTarget:     submitTargetSongTracker,
+			},
+		},
+		{
+			name: "value with spaces and =",
+			contents: `username = cd
+password = "my pass = # secret"
+url = https://example.com/api.php?a=b
+debug = 1
+`,
+			want: &Config{
+				Username:         "cd",
+				Password:         "my pass = # secret",
+				URL:              "https://example.com/api.php?a=b",
+				Debug:            "1",
+				TimeoutSeconds:   defaultTimeoutSeconds,
+				TLSVerify:        true,
+				MaxRetries:       defaultMaxRetries,
+				RetryBaseDelayMs: defaultRetryBaseDelayMs,
+				SubmitTarget:     submitTargetSongTracker,
+			},
+		},
+		{
+			name: "unknown key",
+			contents: `username = cd
+password = mypass
+url = https://example.com/api.php
+debug = 1
+colour = blue
+`,
+			wantErr: true,
+		},
+		{
+			name: "empty key",
+			contents: `username = cd
+password = mypass
+url = https://example.com/api.php
+debug = 1
+= blue
+`,
+			wantErr: true,
+		},
+		{
+			name: "empty value",
+			contents: `username = cd
+password =
+url = https://example.com/api.php
+debug = 1
+`,
+			wantErr: true,
+		},
+		{
+			name: "missing required key",
+			contents: `username = cd
+password = mypass
+debug = 1
+`,
+			wantErr: true,
+		},
+		{
+			name: "line without =",
+			contents: `username = cd
+password mypass
+url = https://example.com/api.php
+debug = 1
+`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeConfig(t, test.contents)
+
+			cfg, err := ParseConfig(path)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, wanted error", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if *cfg != *test.want {
+				t.Errorf("got %+v, wanted %+v", *cfg, *test.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigFileNotFound(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.conf")
+
+	_, err := ParseConfig(path)
+	if err == nil {
+		t.Fatalf("wanted error for missing file")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// cacheControlCacheable is the Cache-Control we send with responses clients may
+// cache.
+const cacheControlCacheable = "private, max-age=300"
+
+// bufferedResponseWriter holds on to what a handler writes so we can look
+// at the body before sending it.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	// status the handler set. 0 if it did not set one.
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status.
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write buffers the body.
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// cacheableResponse sends the response send writes, with an ETag of its
+// body and a Cache-Control header letting clients cache it. the ETag is
+// weak since we hash the body before any compression, so the gzipped and
+// plain responses share it. if the client already has the body (its
+// If-None-Match has the ETag), we respond 304 without the body.
+//
+// we only do this for successful responses. others we send unchanged.
+func cacheableResponse(rw http.ResponseWriter, request *http.Request,
+	send func(http.ResponseWriter) error) error {
+	buffered := &bufferedResponseWriter{ResponseWriter: rw}
+	err := send(buffered)
+	if err != nil {
+		return err
+	}
+
+	if buffered.status != 0 && buffered.status != http.StatusOK {
+		rw.WriteHeader(buffered.status)
+		_, err := rw.Write(buffered.body.Bytes())
+		return err
+	}
+
+	sum := md5.Sum(buffered.body.Bytes())
+	etag := `W/"` + hex.EncodeToString(sum[:]) + `"`
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Cache-Control", cacheControlCacheable)
+
+	if etagMatches(request.Header.Get("If-None-Match"), etag) {
+		rw.Header().Del("Content-Type")
+		rw.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	_, err = rw.Write(buffered.body.Bytes())
+	return err
+}
+
+// etagMatches decides whether an If-None-Match header value includes the
+// ETag. the header may list several ETags, or be *.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	// weak comparison, as If-None-Match uses.
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportFlushRows is how many rows we write to an export before flushing
+// them to the client.
+const exportFlushRows = 1000
+
+// ExportParameters holds the parameters to an export request.
+type ExportParameters struct {
+	UserId int64
+	// export plays from the start of this day. nil for no lower bound.
+	StartDate *time.Time
+	// export plays up to the end of this day. nil for no upper bound.
+	EndDate *time.Time
+}
+
+// getParametersExportPlays retrieves and validates parameters to an export
+// plays request.
+func getParametersExportPlays(request *http.Request) (*ExportParameters,
+	error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	params := &ExportParameters{UserId: userId}
+
+	startDate, exists, err := getDateParameter(request, "start_date")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		params.StartDate = &startDate
+	}
+
+	endDate, exists, err := getDateParameter(request, "end_date")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		params.EndDate = &endDate
+	}
+
+	if params.StartDate != nil && params.EndDate != nil &&
+		params.EndDate.Before(*params.StartDate) {
+		return nil, errors.New("end_date is before start_date")
+	}
+
+	logger.Printf("Parameters: user_id [%d] start_date [%s] end_date [%s]",
+		userId, request.Form.Get("start_date"), request.Form.Get("end_date"))
+	return params, nil
+}
+
+// queryExportPlays starts the query for the plays to export, oldest
+// first. the caller must close the rows.
+func queryExportPlays(ctx context.Context, db *sql.DB,
+	params *ExportParameters) (*sql.Rows, error) {
+	defer observeQuery("export_plays", time.Now(),
+		fmt.Sprintf("user_id [%d]", params.UserId))
+
+	// bounds we were not given are NULL and so do not restrict anything.
+	var start, end interface{}
+	if params.StartDate != nil {
+		start = *params.StartDate
+	}
+	if params.EndDate != nil {
+		// the end date is inclusive.
+		end = params.EndDate.AddDate(0, 0, 1)
+	}
+
+	query := `
+SELECT
+p.id,
+s.artist,
+s.album,
+s.title,
+s.length_ms,
+p.create_time
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND (CAST($2 AS TIMESTAMPTZ) IS NULL OR p.create_time >= $2)
+AND (CAST($3 AS TIMESTAMPTZ) IS NULL OR p.create_time < $3)
+ORDER BY p.create_time, p.id
+`
+	return db.QueryContext(ctx, query, params.UserId, start, end)
+}
+
+// writeExportPlays writes each play row as csv.
+// we flush as we go so that we do not hold the whole export in memory.
+func writeExportPlays(rw http.ResponseWriter, rows *sql.Rows) error {
+	writer := csv.NewWriter(rw)
+
+	err := writer.Write([]string{"play_id", "artist", "album", "title",
+		"length_ms", "played_at"})
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for rows.Next() {
+		var playId, lengthMs int64
+		var artist, album, title string
+		var createTime time.Time
+		err := rows.Scan(&playId, &artist, &album, &title, &lengthMs,
+			&createTime)
+		if err != nil {
+			return err
+		}
+
+		err = writer.Write([]string{
+			strconv.FormatInt(playId, 10),
+			artist,
+			album,
+			title,
+			strconv.FormatInt(lengthMs, 10),
+			createTime.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushRows == 0 {
+			writer.Flush()
+			err := writer.Error()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// handlerExportPlays sends a user's plays as a csv file.
+func handlerExportPlays(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersExportPlays(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	rows, err := queryExportPlays(request.Context(), handler.db, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve plays: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+	defer rows.Close()
+
+	rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	rw.Header().Set("Content-Disposition", `attachment; filename="plays.csv"`)
+	rw.WriteHeader(http.StatusOK)
+
+	// once we start sending the body we can no longer send an error
+	// response, so all we can do is log and stop.
+	err = writeExportPlays(rw, rows)
+	if err != nil {
+		logger.Printf("Failed to write export: %s", err.Error())
+		return
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// feedLimitDefault is how many plays we include in a feed if no limit is
+// given.
+const feedLimitDefault = 20
+
+// feedLimitMax is the most plays we include in a feed.
+const feedLimitMax = 100
+
+// RSS is an RSS 2.0 document.
+type RSS struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel RSSChannel `xml:"channel"`
+}
+
+// RSSChannel is the channel of an RSS document.
+type RSSChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []RSSItem `xml:"item"`
+}
+
+// RSSItem is one item in an RSS channel. each is a play.
+type RSSItem struct {
+	Title       string  `xml:"title"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        RSSGUID `xml:"guid"`
+}
+
+// RSSGUID identifies an item. we use the play ID, which is not a link.
+type RSSGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// getParametersFeedRecent retrieves and validates parameters to a recent
+// plays feed request.
+// we return: user_id, limit.
+func getParametersFeedRecent(request *http.Request) (int64, int64, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err := getOptionalLimitParameter(request, feedLimitDefault,
+		feedLimitMax)
+	if err != nil {
+		return 0, 0, err
+	}
+	logger.Printf("Parameters: user_id [%d] limit [%d]", userId, limit)
+	return userId, limit, nil
+}
+
+// feedLink builds the absolute URL of a user's recent plays feed. RSS
+// requires the channel to have a link.
+func feedLink(request *http.Request, uriPrefix string, userID int64) string {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s/feed/recent?user_id=%d", scheme, request.Host,
+		uriPrefix, userID)
+}
+
+// generateRSSFeed builds an RSS document of the given plays. we return nil
+// if we could not.
+func generateRSSFeed(plays []RecentPlay, userID int64, link string) []byte {
+	items := []RSSItem{}
+	for _, play := range plays {
+		// plays hold their time as RFC3339. RSS wants RFC 822.
+		pubDate := play.CreateTime
+		createTime, err := time.Parse(time.RFC3339, play.CreateTime)
+		if err == nil {
+			pubDate = createTime.Format(time.RFC1123Z)
+		}
+
+		items = append(items, RSSItem{
+			Title: fmt.Sprintf("%s - %s", play.Artist, play.Title),
+			Description: fmt.Sprintf("%s · %d seconds", play.Album,
+				play.LengthMs/1000),
+			PubDate: pubDate,
+			GUID: RSSGUID{
+				IsPermaLink: "false",
+				Value:       strconv.FormatInt(play.PlayId, 10),
+			},
+		})
+	}
+
+	feed := RSS{
+		Version: "2.0",
+		Channel: RSSChannel{
+			Title: fmt.Sprintf("Recently played by user %d", userID),
+			Link:  link,
+			Description: fmt.Sprintf("The songs user %d played most recently",
+				userID),
+			Items: items,
+		},
+	}
+
+	b, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Printf("Unable to generate feed: %s", err.Error())
+		return nil
+	}
+	return append([]byte(xml.Header), b...)
+}
+
+// handlerFeedRecent sends an RSS feed of a user's most recent plays.
+func handlerFeedRecent(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, limit, err := getParametersFeedRecent(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	plays, err := retrieveRecentPlays(request.Context(), handler.db, userId,
+		limit, 0)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve recent plays: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	feed := generateRSSFeed(plays, userId,
+		feedLink(request, handler.settings.UriPrefix, userId))
+	if feed == nil {
+		send500Error(rw, "Failed to generate response")
+		return
+	}
+	rw.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	_, err = rw.Write(feed)
+	if err != nil {
+		logger.Printf("Unable to write feed: %s", err.Error())
+	}
+}
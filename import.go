@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// importPlaysMax is the most plays we accept in one import request.
+const importPlaysMax = 10000
+
+// ImportPlay is one play in an import request.
+type ImportPlay struct {
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Title    string `json:"title"`
+	LengthMs int64  `json:"length_ms"`
+	// RFC3339.
+	PlayedAt string `json:"played_at"`
+}
+
+// ImportRequest is the body of an import plays request.
+type ImportRequest struct {
+	UserId int64        `json:"user_id"`
+	Plays  []ImportPlay `json:"plays"`
+}
+
+// ImportResult is the body we send in response to an import plays request.
+type ImportResult struct {
+	Imported int64 `json:"imported"`
+	// plays we already had.
+	Skipped int64 `json:"skipped"`
+	// plays we could not import, and why.
+	Errors []string `json:"errors"`
+}
+
+// getParametersImportPlays retrieves and validates the body of an import
+// plays request. we validate the individual plays as we import them.
+func getParametersImportPlays(request *http.Request) (*ImportRequest,
+	error) {
+	logger := requestLogger(request)
+
+	var params ImportRequest
+	err := json.NewDecoder(request.Body).Decode(&params)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid request body: %s", err.Error())
+	}
+
+	if params.UserId < 1 {
+		return nil, errors.New("Invalid user ID")
+	}
+	if len(params.Plays) == 0 {
+		return nil, errors.New("No plays given")
+	}
+	if len(params.Plays) > importPlaysMax {
+		return nil, fmt.Errorf("Too many plays. At most %d are allowed",
+			importPlaysMax)
+	}
+	logger.Printf("Parameters: user_id [%d] plays [%d]", params.UserId,
+		len(params.Plays))
+	return &params, nil
+}
+
+// validateImportPlay checks a play from an import request. we return the
+// time of the play.
+func validateImportPlay(play *ImportPlay) (time.Time, error) {
+	if len(play.Artist) == 0 {
+		return time.Time{}, errors.New("No artist given")
+	}
+	if len(play.Album) == 0 {
+		return time.Time{}, errors.New("No album given")
+	}
+	if len(play.Title) == 0 {
+		return time.Time{}, errors.New("No title given")
+	}
+	if play.LengthMs < 1 {
+		return time.Time{}, errors.New("Invalid length")
+	}
+	playedAt, err := time.Parse(time.RFC3339, play.PlayedAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid played_at: %s", err.Error())
+	}
+	return playedAt, nil
+}
+
+// importPlay adds one play within the import transaction. we add the song
+// if necessary.
+// we return whether we added the play. we do not if the user already has a
+// play of the song at that time.
+func importPlay(ctx context.Context, tx *sql.Tx, userId int64,
+	play *ImportPlay, playedAt time.Time) (bool, error) {
+	songId, err := retrieveOrCreateSong(ctx, tx, &SongDetails{
+		Artist:   play.Artist,
+		Album:    play.Album,
+		Title:    play.Title,
+		LengthMs: play.LengthMs,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+SELECT COUNT(*) FROM play
+WHERE
+user_id = $1
+AND song_id = $2
+AND create_time = $3
+`
+	var count int64
+	err = tx.QueryRowContext(ctx, query, userId, songId, playedAt).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	query = `
+INSERT INTO play
+(user_id, song_id, create_time)
+VALUES($1, $2, $3)
+`
+	_, err = tx.ExecContext(ctx, query, userId, songId, playedAt)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// importPlays adds the plays in the request in a single transaction.
+//
+// a play that is invalid or that fails to insert does not abort the
+// import. we note it in the result and carry on. each play gets its own
+// savepoint so that a failed statement does not spoil the transaction.
+func importPlays(ctx context.Context, db *sql.DB,
+	params *ImportRequest) (*ImportResult, error) {
+	defer observeQuery("import_plays", time.Now(),
+		fmt.Sprintf("user_id [%d] plays [%d]", params.UserId,
+			len(params.Plays)))
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{Errors: []string{}}
+	for i := range params.Plays {
+		play := &params.Plays[i]
+
+		playedAt, err := validateImportPlay(play)
+		if err != nil {
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("play %d: %s", i, err.Error()))
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, "SAVEPOINT import_play")
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		added, err := importPlay(ctx, tx, params.UserId, play, playedAt)
+		if err != nil {
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("play %d: %s", i, err.Error()))
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_play")
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT import_play")
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		if added {
+			result.Imported++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// handlerImportPlays imports a batch of plays, such as ones exported from
+// another instance.
+func handlerImportPlays(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersImportPlays(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	result, err := importPlays(request.Context(), handler.db, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to import plays: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+	logger.Printf("Imported plays: imported [%d] skipped [%d] errors [%d]",
+		result.Imported, result.Skipped, len(result.Errors))
+	if result.Imported > 0 {
+		handler.cache.invalidateUser(params.UserId)
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, result)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
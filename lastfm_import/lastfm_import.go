@@ -0,0 +1,554 @@
+/*
+ * import a user's listening history from Last.fm into the song tracker.
+ *
+ * we page through the user's scrobbles using the Last.fm user.getRecentTracks
+ * API, and send each page of them to the song tracker's import API. the
+ * import API keeps the time of each play and skips plays it already has.
+ *
+ * Last.fm allows 5 requests a second, so we make no more than that.
+ *
+ * we remember which pages we imported in a checkpoint file. if we are
+ * interrupted, running again with the same checkpoint file carries on where
+ * we left off. we remove the checkpoint file once we finish.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Args describes arguments on command line
+type Args struct {
+	// LastfmUser is the Last.fm username to import.
+	LastfmUser string
+
+	// LastfmAPIKey is the key to use with the Last.fm API.
+	LastfmAPIKey string
+
+	// URL is the base URL of the song tracker, such as
+	// http://localhost:8080/songs.
+	URL string
+
+	// APIKey is the key to use with the song tracker API.
+	APIKey string
+
+	// UserID is the song tracker user to import the plays for.
+	UserID int64
+
+	// Checkpoint is path to the file holding our progress.
+	Checkpoint string
+
+	// DefaultLengthSeconds is the length to record for songs Last.fm does
+	// not know the length of.
+	DefaultLengthSeconds int
+}
+
+// Checkpoint is our progress through an import. we keep it in the
+// checkpoint file as JSON.
+type Checkpoint struct {
+	LastfmUser string `json:"lastfm_user"`
+	// we only import scrobbles before this time (unix seconds). this keeps
+	// the pages the same if there are new scrobbles while we import.
+	To int64 `json:"to"`
+	// the last page we imported. pages count from 1.
+	Page int `json:"page"`
+	// plays we imported so far, and plays the song tracker already had.
+	Imported int64 `json:"imported"`
+	Skipped  int64 `json:"skipped"`
+}
+
+// lastfmAPIURL is where we make Last.fm API requests.
+const lastfmAPIURL = "https://ws.audioscrobbler.com/2.0/"
+
+// lastfmPageSize is how many scrobbles we ask for in each page. this is
+// the most Last.fm allows.
+const lastfmPageSize = 200
+
+// lastfmRequestInterval is how long we wait between Last.fm API requests
+// so that we stay under its limit of 5 a second.
+const lastfmRequestInterval = 200 * time.Millisecond
+
+// httpTimeout is how long we wait for a response to any request.
+const httpTimeout = 30 * time.Second
+
+// LastfmText is how Last.fm represents some values, such as an artist's
+// name.
+type LastfmText struct {
+	Text string `json:"#text"`
+}
+
+// LastfmTrack is one scrobble in a recent tracks response.
+type LastfmTrack struct {
+	Artist LastfmText `json:"artist"`
+	Album  LastfmText `json:"album"`
+	Name   string     `json:"name"`
+	Date   struct {
+		UTS string `json:"uts"`
+	} `json:"date"`
+	Attr struct {
+		NowPlaying string `json:"nowplaying"`
+	} `json:"@attr"`
+}
+
+// LastfmRecentTracks is the body of a recent tracks response.
+type LastfmRecentTracks struct {
+	RecentTracks struct {
+		// Last.fm sends a single track as an object rather than an array.
+		Track json.RawMessage `json:"track"`
+		Attr  struct {
+			Page       string `json:"page"`
+			TotalPages string `json:"totalPages"`
+		} `json:"@attr"`
+	} `json:"recenttracks"`
+}
+
+// LastfmTrackInfo is the body of a track info response.
+type LastfmTrackInfo struct {
+	Track struct {
+		// milliseconds. 0 if Last.fm does not know.
+		Duration string `json:"duration"`
+	} `json:"track"`
+}
+
+// LastfmError is the body of a Last.fm error response.
+type LastfmError struct {
+	Code    int    `json:"error"`
+	Message string `json:"message"`
+}
+
+// Error is part of the error interface
+func (e *LastfmError) Error() string {
+	return fmt.Sprintf("Last.fm error %d: %s", e.Code, e.Message)
+}
+
+// ImportPlay is one play in a song tracker import request.
+type ImportPlay struct {
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Title    string `json:"title"`
+	LengthMs int64  `json:"length_ms"`
+	PlayedAt string `json:"played_at"`
+}
+
+// ImportRequest is the body of a song tracker import request.
+type ImportRequest struct {
+	UserID int64        `json:"user_id"`
+	Plays  []ImportPlay `json:"plays"`
+}
+
+// ImportResult is the body of a song tracker import response.
+type ImportResult struct {
+	Imported int64    `json:"imported"`
+	Skipped  int64    `json:"skipped"`
+	Errors   []string `json:"errors"`
+}
+
+// Importer holds what we need while importing.
+type Importer struct {
+	args       *Args
+	httpClient *http.Client
+	// we take from this before each Last.fm request.
+	lastfmTick <-chan time.Time
+	// track lengths in milliseconds we looked up, by artist and title.
+	lengths map[string]int64
+}
+
+// main is the program entry
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime)
+
+	args, err := getArgs()
+	if err != nil {
+		log.Printf(err.Error())
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	checkpoint, err := loadCheckpoint(args.Checkpoint, args.LastfmUser)
+	if err != nil {
+		log.Printf("Unable to load checkpoint: %s", err.Error())
+		os.Exit(1)
+	}
+	if checkpoint.Page > 0 {
+		log.Printf("Resuming after page %d", checkpoint.Page)
+	}
+
+	ticker := time.NewTicker(lastfmRequestInterval)
+	defer ticker.Stop()
+
+	importer := &Importer{
+		args:       args,
+		httpClient: &http.Client{Timeout: httpTimeout},
+		lastfmTick: ticker.C,
+		lengths:    map[string]int64{},
+	}
+
+	err = importer.run(checkpoint)
+	if err != nil {
+		log.Printf("Import failed: %s", err.Error())
+		log.Printf("Imported %d plays before failing. Run again to resume",
+			checkpoint.Imported)
+		ticker.Stop()
+		os.Exit(1)
+	}
+
+	err = os.Remove(args.Checkpoint)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove checkpoint: %s", err.Error())
+	}
+
+	log.Printf("Imported %d plays (%d already recorded)", checkpoint.Imported,
+		checkpoint.Skipped)
+}
+
+// getArgs retrieves and validates command line arguments
+func getArgs() (*Args, error) {
+	lastfmUser := flag.String("lastfm-user", "", "Last.fm username to import")
+	lastfmAPIKey := flag.String("lastfm-api-key", "", "Last.fm API key")
+	apiURL := flag.String("url", "",
+		"Base URL of the song tracker, such as http://localhost:8080/songs")
+	apiKey := flag.String("api-key", "", "Song tracker API key")
+	userID := flag.Int64("user-id", 0, "Song tracker user ID to import plays for")
+	checkpoint := flag.String("checkpoint", "lastfm_import.checkpoint",
+		"Path to the file holding our progress")
+	defaultLength := flag.Int("default-length", 240,
+		"Length in seconds to record for songs Last.fm does not know the length of")
+
+	flag.Parse()
+
+	if len(*lastfmUser) == 0 {
+		return nil, errors.New("You must specify a Last.fm username")
+	}
+	if len(*lastfmAPIKey) == 0 {
+		return nil, errors.New("You must specify a Last.fm API key")
+	}
+	if len(*apiURL) == 0 {
+		return nil, errors.New("You must specify the song tracker URL")
+	}
+	if *userID < 1 {
+		return nil, errors.New("You must specify a valid user ID")
+	}
+	if len(*checkpoint) == 0 {
+		return nil, errors.New("You must specify a checkpoint file")
+	}
+	if *defaultLength < 1 {
+		return nil, errors.New("Default length must be positive")
+	}
+
+	return &Args{
+		LastfmUser:           *lastfmUser,
+		LastfmAPIKey:         *lastfmAPIKey,
+		URL:                  *apiURL,
+		APIKey:               *apiKey,
+		UserID:               *userID,
+		Checkpoint:           *checkpoint,
+		DefaultLengthSeconds: *defaultLength,
+	}, nil
+}
+
+// loadCheckpoint reads our progress from the checkpoint file. if there is
+// no file, we start a new import.
+func loadCheckpoint(path string, lastfmUser string) (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Checkpoint{
+				LastfmUser: lastfmUser,
+				To:         time.Now().Unix(),
+			}, nil
+		}
+		return nil, err
+	}
+
+	var checkpoint Checkpoint
+	err = json.Unmarshal(b, &checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if checkpoint.LastfmUser != lastfmUser {
+		return nil, fmt.Errorf("%s is for Last.fm user %s", path,
+			checkpoint.LastfmUser)
+	}
+	return &checkpoint, nil
+}
+
+// saveCheckpoint writes our progress to the checkpoint file. we write a
+// temporary file and rename it so we never leave a partial one.
+func saveCheckpoint(path string, checkpoint *Checkpoint) error {
+	b, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// run imports each page after the one in the checkpoint. we save the
+// checkpoint after each page.
+func (i *Importer) run(checkpoint *Checkpoint) error {
+	for page := checkpoint.Page + 1; ; page++ {
+		tracks, totalPages, err := i.retrieveRecentTracks(checkpoint.To, page)
+		if err != nil {
+			return fmt.Errorf("Unable to retrieve page %d: %s", page, err.Error())
+		}
+
+		plays, err := i.buildPlays(tracks)
+		if err != nil {
+			return fmt.Errorf("Unable to build plays for page %d: %s", page,
+				err.Error())
+		}
+
+		if len(plays) > 0 {
+			result, err := i.importPlays(plays)
+			if err != nil {
+				return fmt.Errorf("Unable to import page %d: %s", page, err.Error())
+			}
+			for _, e := range result.Errors {
+				log.Printf("Warning: Page %d: %s", page, e)
+			}
+			checkpoint.Imported += result.Imported
+			checkpoint.Skipped += result.Skipped
+		}
+
+		checkpoint.Page = page
+		err = saveCheckpoint(i.args.Checkpoint, checkpoint)
+		if err != nil {
+			return fmt.Errorf("Unable to save checkpoint: %s", err.Error())
+		}
+		log.Printf("Imported page %d of %d", page, totalPages)
+
+		if page >= totalPages {
+			return nil
+		}
+	}
+}
+
+// retrieveRecentTracks retrieves one page of the user's scrobbles from
+// before the given time. we return the scrobbles and how many pages there
+// are.
+func (i *Importer) retrieveRecentTracks(to int64, page int) ([]LastfmTrack,
+	int, error) {
+	v := url.Values{}
+	v.Set("method", "user.getrecenttracks")
+	v.Set("user", i.args.LastfmUser)
+	v.Set("to", strconv.FormatInt(to, 10))
+	v.Set("limit", strconv.Itoa(lastfmPageSize))
+	v.Set("page", strconv.Itoa(page))
+
+	var response LastfmRecentTracks
+	err := i.lastfmRequest(v, &response)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	totalPages, err := strconv.Atoi(response.RecentTracks.Attr.TotalPages)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid total pages: %s",
+			response.RecentTracks.Attr.TotalPages)
+	}
+
+	tracks, err := decodeTracks(response.RecentTracks.Track)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tracks, totalPages, nil
+}
+
+// decodeTracks decodes the tracks in a recent tracks response. they may be
+// absent, an array, or a single object.
+func decodeTracks(raw json.RawMessage) ([]LastfmTrack, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	if raw[0] == '[' {
+		var tracks []LastfmTrack
+		err := json.Unmarshal(raw, &tracks)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tracks: %s", err.Error())
+		}
+		return tracks, nil
+	}
+
+	var track LastfmTrack
+	err := json.Unmarshal(raw, &track)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid track: %s", err.Error())
+	}
+	return []LastfmTrack{track}, nil
+}
+
+// buildPlays turns scrobbles into plays to import. we skip the track
+// being played now, as it has no time yet, and any without an artist,
+// album, or title, as the song tracker requires them.
+func (i *Importer) buildPlays(tracks []LastfmTrack) ([]ImportPlay, error) {
+	var plays []ImportPlay
+	for _, track := range tracks {
+		if track.Attr.NowPlaying == "true" {
+			continue
+		}
+
+		if len(track.Artist.Text) == 0 ||
+			len(track.Album.Text) == 0 ||
+			len(track.Name) == 0 {
+			log.Printf("Warning: Skipping scrobble missing artist, album, or title: %s - %s",
+				track.Artist.Text, track.Name)
+			continue
+		}
+
+		uts, err := strconv.ParseInt(track.Date.UTS, 10, 64)
+		if err != nil {
+			log.Printf("Warning: Skipping scrobble with invalid time: %s - %s",
+				track.Artist.Text, track.Name)
+			continue
+		}
+
+		lengthMs, err := i.retrieveTrackLength(track.Artist.Text, track.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		plays = append(plays, ImportPlay{
+			Artist:   track.Artist.Text,
+			Album:    track.Album.Text,
+			Title:    track.Name,
+			LengthMs: lengthMs,
+			PlayedAt: time.Unix(uts, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	return plays, nil
+}
+
+// retrieveTrackLength finds a track's length in milliseconds. recent
+// tracks do not include it, so we ask Last.fm for each track once. if
+// Last.fm does not know it, we use the default length.
+func (i *Importer) retrieveTrackLength(artist string, title string) (int64,
+	error) {
+	key := artist + "\x00" + title
+	if lengthMs, ok := i.lengths[key]; ok {
+		return lengthMs, nil
+	}
+
+	v := url.Values{}
+	v.Set("method", "track.getinfo")
+	v.Set("artist", artist)
+	v.Set("track", title)
+	v.Set("autocorrect", "0")
+
+	lengthMs := int64(i.args.DefaultLengthSeconds) * 1000
+
+	var response LastfmTrackInfo
+	err := i.lastfmRequest(v, &response)
+	if err != nil {
+		// Last.fm may not know the track at all. that is fine.
+		var lastfmErr *LastfmError
+		if !errors.As(err, &lastfmErr) {
+			return 0, err
+		}
+	} else {
+		duration, err := strconv.ParseInt(response.Track.Duration, 10, 64)
+		if err == nil && duration > 0 {
+			lengthMs = duration
+		}
+	}
+
+	i.lengths[key] = lengthMs
+	return lengthMs, nil
+}
+
+// lastfmRequest makes a Last.fm API request and decodes the response. we
+// wait first so we stay under the rate limit.
+func (i *Importer) lastfmRequest(v url.Values, response interface{}) error {
+	<-i.lastfmTick
+
+	v.Set("api_key", i.args.LastfmAPIKey)
+	v.Set("format", "json")
+
+	httpResponse, err := i.httpClient.Get(lastfmAPIURL + "?" + v.Encode())
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	httpResponse.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to read response body: %s", err.Error())
+	}
+
+	// Last.fm reports errors in the body, sometimes with a 200.
+	var lastfmErr LastfmError
+	if json.Unmarshal(body, &lastfmErr) == nil && lastfmErr.Code != 0 {
+		return &lastfmErr
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP code %d", httpResponse.StatusCode)
+	}
+
+	err = json.Unmarshal(body, response)
+	if err != nil {
+		return fmt.Errorf("Invalid response: %s", err.Error())
+	}
+	return nil
+}
+
+// importPlays sends plays to the song tracker's import API.
+func (i *Importer) importPlays(plays []ImportPlay) (*ImportResult, error) {
+	b, err := json.Marshal(ImportRequest{
+		UserID: i.args.UserID,
+		Plays:  plays,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost,
+		i.args.URL+"/import/plays", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(i.args.APIKey) > 0 {
+		request.Header.Set("Authorization", "Bearer "+i.args.APIKey)
+	}
+
+	httpResponse, err := i.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	httpResponse.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response body: %s", err.Error())
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP code %d: %s", httpResponse.StatusCode, body)
+	}
+
+	var result ImportResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid response: %s", err.Error())
+	}
+	return &result, nil
+}
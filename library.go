@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// artistsLimitDefault is how many artists we list if no limit is given.
+const artistsLimitDefault = 100
+
+// artistsLimitMax is the largest limit we accept when listing artists.
+const artistsLimitMax = 1000
+
+// searchLimit is how many songs we respond with for a song search.
+const searchLimit = 50
+
+// searchQueryMinLength is the shortest query we accept for a song search.
+const searchQueryMinLength = 2
+
+// SongHistory describes a user's plays of a single song.
+type SongHistory struct {
+	// RFC3339.
+	FirstPlay  string `json:"first_play"`
+	LastPlay   string `json:"last_play"`
+	TotalPlays int64  `json:"total_plays"`
+}
+
+// getParametersSongHistory retrieves and validates parameters to a song
+// history request.
+// we return: user_id, artist, title.
+func getParametersSongHistory(request *http.Request) (int64, string,
+	string, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, "", "", err
+	}
+	artist, err := getStringParameter(request, "artist")
+	if err != nil {
+		return 0, "", "", err
+	}
+	title, err := getStringParameter(request, "title")
+	if err != nil {
+		return 0, "", "", err
+	}
+	logger.Printf("Parameters: user_id [%d] artist [%s] title [%s]", userId,
+		artist, title)
+	return userId, artist, title, nil
+}
+
+// retrieveSongHistory finds when the given user first and last played a
+// song, and how many times. the artist and title must match exactly.
+// if the user has never played the song, we return nil.
+func retrieveSongHistory(ctx context.Context, db *sql.DB, userId int64,
+	artist string, title string) (*SongHistory, error) {
+	defer observeQuery("song_history", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	query := `
+SELECT
+MIN(p.create_time),
+MAX(p.create_time),
+COUNT(*)
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.artist = $2
+AND s.title = $3
+`
+	var firstPlay, lastPlay sql.NullTime
+	var count int64
+	err := db.QueryRowContext(ctx, query, userId, artist, title).Scan(
+		&firstPlay, &lastPlay, &count)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	return &SongHistory{
+		FirstPlay:  firstPlay.Time.Format(time.RFC3339),
+		LastPlay:   lastPlay.Time.Format(time.RFC3339),
+		TotalPlays: count,
+	}, nil
+}
+
+// handlerSongHistory looks up when a user first and last played a song.
+func handlerSongHistory(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, artist, title, err := getParametersSongHistory(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	history, err := retrieveSongHistory(request.Context(), handler.db, userId,
+		artist, title)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve song history: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+	if history == nil {
+		send404Error(rw, "No plays found for that song")
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, history)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// ArtistsParameters holds the parameters to an artists request.
+type ArtistsParameters struct {
+	UserId int64
+	// only list artists starting with this (case insensitive). may be blank.
+	Prefix string
+	Limit  int64
+	Offset int64
+}
+
+// ArtistsResponse is the body we send in response to an artists request.
+type ArtistsResponse struct {
+	Artists []string `json:"artists"`
+	// how many artists there are in total, ignoring limit and offset.
+	Total int64 `json:"total"`
+}
+
+// getParametersArtists retrieves and validates parameters to an artists
+// request.
+func getParametersArtists(request *http.Request) (*ArtistsParameters,
+	error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSpace(request.Form.Get("prefix"))
+	limit, err := getOptionalLimitParameter(request, artistsLimitDefault,
+		artistsLimitMax)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := getOffsetParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Parameters: user_id [%d] prefix [%s] limit [%d] offset [%d]",
+		userId, prefix, limit, offset)
+	return &ArtistsParameters{
+		UserId: userId,
+		Prefix: prefix,
+		Limit:  limit,
+		Offset: offset,
+	}, nil
+}
+
+// escapeLikePattern escapes the characters that are special in a LIKE
+// pattern so the string matches literally.
+func escapeLikePattern(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "%", `\%`, -1)
+	return strings.Replace(s, "_", `\_`, -1)
+}
+
+// retrieveArtists lists the distinct artists the given user has played,
+// sorted alphabetically.
+// we return the page of artists and how many there are in total.
+func retrieveArtists(ctx context.Context, db *sql.DB,
+	params *ArtistsParameters) ([]string, int64, error) {
+	defer observeQuery("artists", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", params.UserId,
+			params.Limit))
+
+	pattern := escapeLikePattern(strings.ToLower(params.Prefix)) + "%"
+
+	query := `
+SELECT DISTINCT s.artist
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND LOWER(s.artist) LIKE $2
+ORDER BY s.artist
+LIMIT $3
+OFFSET $4
+`
+	rows, err := db.QueryContext(ctx, query, params.UserId, pattern,
+		params.Limit, params.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	artists := []string{}
+	for rows.Next() {
+		var artist string
+		err := rows.Scan(&artist)
+		if err != nil {
+			return nil, 0, err
+		}
+		artists = append(artists, artist)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = `
+SELECT COUNT(DISTINCT s.artist)
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND LOWER(s.artist) LIKE $2
+`
+	var total int64
+	err = db.QueryRowContext(ctx, query, params.UserId, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	return artists, total, nil
+}
+
+// handlerArtists lists the artists a user has played.
+func handlerArtists(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersArtists(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	artists, total, err := retrieveArtists(request.Context(), handler.db,
+		params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve artists: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK,
+		ArtistsResponse{Artists: artists, Total: total})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// AlbumSummary describes a user's plays of one album.
+type AlbumSummary struct {
+	Album     string `json:"album"`
+	PlayCount int64  `json:"play_count"`
+	// RFC3339.
+	FirstPlay string `json:"first_play"`
+	LastPlay  string `json:"last_play"`
+}
+
+// AlbumsResponse is the body we send in response to an albums for artist
+// request.
+type AlbumsResponse struct {
+	Albums []AlbumSummary `json:"albums"`
+}
+
+// getParametersAlbumsForArtist retrieves and validates parameters to an
+// albums for artist request.
+// we return: user_id, artist.
+func getParametersAlbumsForArtist(request *http.Request) (int64, string,
+	error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, "", err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, "", err
+	}
+	artist, err := getStringParameter(request, "artist")
+	if err != nil {
+		return 0, "", err
+	}
+	logger.Printf("Parameters: user_id [%d] artist [%s]", userId, artist)
+	return userId, artist, nil
+}
+
+// retrieveAlbumsForArtist lists the albums by the given artist that the
+// user has played, in the order the user first played them. the artist
+// must match exactly.
+func retrieveAlbumsForArtist(ctx context.Context, db *sql.DB, userId int64,
+	artist string) ([]AlbumSummary, error) {
+	defer observeQuery("albums_for_artist", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	query := `
+SELECT
+s.album,
+COUNT(*) AS play_count,
+MIN(p.create_time) AS first_play,
+MAX(p.create_time) AS last_play
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.artist = $2
+GROUP BY s.album
+ORDER BY first_play
+`
+	rows, err := db.QueryContext(ctx, query, userId, artist)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := []AlbumSummary{}
+	for rows.Next() {
+		var album AlbumSummary
+		var firstPlay, lastPlay time.Time
+		err := rows.Scan(&album.Album, &album.PlayCount, &firstPlay, &lastPlay)
+		if err != nil {
+			return nil, err
+		}
+		album.FirstPlay = firstPlay.Format(time.RFC3339)
+		album.LastPlay = lastPlay.Format(time.RFC3339)
+		albums = append(albums, album)
+	}
+	return albums, rows.Err()
+}
+
+// handlerAlbumsForArtist lists the albums by an artist that a user has
+// played.
+func handlerAlbumsForArtist(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, artist, err := getParametersAlbumsForArtist(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	albums, err := retrieveAlbumsForArtist(request.Context(), handler.db,
+		userId, artist)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve albums: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, AlbumsResponse{Albums: albums})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// SearchResult is a song matching a song search.
+type SearchResult struct {
+	Artist    string `json:"artist"`
+	Title     string `json:"title"`
+	Album     string `json:"album"`
+	PlayCount int64  `json:"play_count"`
+}
+
+// SearchResponse is the body we send in response to a song search.
+type SearchResponse struct {
+	Songs []SearchResult `json:"songs"`
+}
+
+// getParametersSearchSongs retrieves and validates parameters to a song
+// search request.
+// we return: user_id, q.
+func getParametersSearchSongs(request *http.Request) (int64, string,
+	error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, "", err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, "", err
+	}
+	query := strings.TrimSpace(request.Form.Get("q"))
+	if len([]rune(query)) < searchQueryMinLength {
+		return 0, "", fmt.Errorf("q must be at least %d characters",
+			searchQueryMinLength)
+	}
+	logger.Printf("Parameters: user_id [%d] q [%s]", userId, query)
+	return userId, query, nil
+}
+
+// searchSongs finds songs the given user has played whose artist or title
+// contains the query, ignoring case. we list the songs the user played
+// most first.
+func searchSongs(ctx context.Context, db *sql.DB, userId int64,
+	query string) ([]SearchResult, error) {
+	defer observeQuery("search_songs", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	// the query matches literally. % and _ are not wildcards.
+	pattern := "%" + escapeLikePattern(strings.ToLower(query)) + "%"
+
+	sqlQuery := `
+SELECT
+s.artist,
+s.title,
+s.album,
+COUNT(*) AS play_count
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND (LOWER(s.artist) LIKE $2 OR LOWER(s.title) LIKE $2)
+GROUP BY s.artist, s.title, s.album
+ORDER BY play_count DESC, s.artist, s.title
+LIMIT $3
+`
+	rows, err := db.QueryContext(ctx, sqlQuery, userId, pattern, searchLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		err := rows.Scan(&result.Artist, &result.Title, &result.Album,
+			&result.PlayCount)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// handlerSearchSongs finds songs a user has played by part of their artist
+// or title.
+func handlerSearchSongs(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, query, err := getParametersSearchSongs(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	songs, err := searchSongs(request.Context(), handler.db, userId, query)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to search songs: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, SearchResponse{Songs: songs})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
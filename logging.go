@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// jsonLogWriter is an io.Writer that reformats each log line it is given
+// as a json object with time, level, and msg keys.
+// we log parameters in the style 'name [value]'. we pull these out of the
+// message as extra keys so log aggregators can filter on them.
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+// logFieldPattern matches a 'name [value]' field in a log message.
+var logFieldPattern = regexp.MustCompile(`\b([a-z][a-z_]*) \[([^\]]*)\]`)
+
+// requestIDPrefixPattern matches the prefix on log lines about a request.
+var requestIDPrefixPattern = regexp.MustCompile(`^request_id \[[^\]]*\] `)
+
+// Write implements io.Writer. the log package calls this once per line.
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+
+	entry := map[string]string{}
+	for _, match := range logFieldPattern.FindAllStringSubmatch(msg, -1) {
+		entry[match[1]] = match[2]
+	}
+	entry["time"] = time.Now().Format(time.RFC3339)
+	entry["level"] = logLevel(requestIDPrefixPattern.ReplaceAllString(msg, ""))
+	entry["msg"] = msg
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.out.Write(append(b, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logLevel decides the level of a log message from how it starts.
+func logLevel(msg string) string {
+	if strings.HasPrefix(msg, "Failed") || strings.HasPrefix(msg, "Error") {
+		return "error"
+	}
+	if strings.HasPrefix(strings.ToLower(msg), "warning") {
+		return "warning"
+	}
+	return "info"
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "song_tracker_http_requests_total",
+		Help: "HTTP requests served, by method, path, and status code.",
+	}, []string{"method", "path", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "song_tracker_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "path"})
+
+	dbQueriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "song_tracker_db_queries_total",
+		Help: "Database queries run, by query name.",
+	}, []string{"query_name"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "song_tracker_db_query_duration_seconds",
+		Help:    "Time taken by database queries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query_name"})
+)
+
+// statusRecorder is a http.ResponseWriter that remembers the status code
+// sent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// metricsMiddleware records how long each request takes and counts
+// requests by their status code. path is the route's path, which we use
+// rather than the request's so that we have a fixed set of labels.
+func metricsMiddleware(path string,
+	next RequestHandlerFunc) RequestHandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request,
+		handler *HttpHandler) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+
+		next(recorder, request, handler)
+
+		httpRequestDuration.WithLabelValues(request.Method, path).Observe(
+			time.Since(start).Seconds())
+		httpRequestsTotal.WithLabelValues(request.Method, path,
+			strconv.Itoa(recorder.status)).Inc()
+	}
+}
+
+// slowQueryThreshold is how long a query may take before we log it as
+// slow. we set it from the config at startup.
+var slowQueryThreshold = defaultSlowQueryThresholdMs * time.Millisecond
+
+// observeQuery records a database query. call it with defer and the time
+// the query started. params describes the query's key parameters (e.g.
+// user_id [1]). we include them in the log if the query is slow.
+func observeQuery(name string, start time.Time, params string) {
+	duration := time.Since(start)
+	dbQueriesTotal.WithLabelValues(name).Inc()
+	dbQueryDuration.WithLabelValues(name).Observe(duration.Seconds())
+
+	if duration > slowQueryThreshold {
+		log.Printf("Warning: Slow query: query_name [%s] duration_ms [%d] %s",
+			name, duration.Milliseconds(), params)
+	}
+}
+
+// metricsHandler serves our metrics. we build it once rather than on each
+// scrape.
+var metricsHandler = promhttp.Handler()
+
+// handlerMetrics exposes our metrics for Prometheus to scrape.
+func handlerMetrics(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	metricsHandler.ServeHTTP(rw, request)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// contextKey is the type of keys for values we store in a request's
+// context.
+type contextKey int
+
+const (
+	// requestIDKey holds the request's ID.
+	requestIDKey contextKey = iota
+	// requestLoggerKey holds a logger that prefixes lines with the
+	// request's ID.
+	requestLoggerKey
+	// pathParametersKey holds the parameters we found in the request's
+	// path.
+	pathParametersKey
+)
+
+// validRequestIDPattern matches request IDs we accept from clients. we
+// are strict as they end up in our logs.
+var validRequestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware gives each request an ID so we can tell which log
+// lines belong to it. we use the client's X-Request-ID header if it sends
+// a valid one, and generate one otherwise. we send the ID back in the
+// X-Request-ID response header.
+func requestIDMiddleware(next RequestHandlerFunc) RequestHandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request,
+		handler *HttpHandler) {
+		id := request.Header.Get("X-Request-ID")
+		if !validRequestIDPattern.MatchString(id) {
+			var err error
+			id, err = newRequestID()
+			if err != nil {
+				log.Printf("Failed to generate request ID: %s", err.Error())
+				send500Error(rw, "Failed to generate request ID")
+				return
+			}
+		}
+
+		logger := log.New(log.Writer(), fmt.Sprintf("request_id [%s] ", id),
+			log.Flags()|log.Lmsgprefix)
+
+		ctx := context.WithValue(request.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, requestLoggerKey, logger)
+
+		rw.Header().Set("X-Request-ID", id)
+		logger.Printf("Handling request: method [%s] path [%s]", request.Method,
+			request.URL.Path)
+		next(rw, request.WithContext(ctx), handler)
+	}
+}
+
+// authMiddleware requires the request to carry one of our API keys as a
+// bearer token. if we have no API keys, we let every request through.
+//
+// we must never log the keys, including the one the client sent.
+func authMiddleware(next RequestHandlerFunc) RequestHandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request,
+		handler *HttpHandler) {
+		keys := handler.settings.apiKeys()
+		if len(keys) == 0 {
+			next(rw, request, handler)
+			return
+		}
+
+		if !validBearerToken(request, keys) {
+			sendUnauthorized(rw, request)
+			return
+		}
+
+		next(rw, request, handler)
+	}
+}
+
+// adminAuthMiddleware requires the request to carry one of our admin API
+// keys as a bearer token. unlike with regular keys, if we have no admin
+// keys we refuse every request.
+func adminAuthMiddleware(next RequestHandlerFunc) RequestHandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request,
+		handler *HttpHandler) {
+		if !validBearerToken(request, handler.settings.adminAPIKeys()) {
+			sendUnauthorized(rw, request)
+			return
+		}
+
+		next(rw, request, handler)
+	}
+}
+
+// validBearerToken decides whether the request's Authorization header holds
+// one of the keys as a bearer token.
+func validBearerToken(request *http.Request, keys []string) bool {
+	authorization := request.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization {
+		return false
+	}
+	return validAPIKey(keys, token)
+}
+
+// sendUnauthorized responds to a request that did not authenticate.
+func sendUnauthorized(rw http.ResponseWriter, request *http.Request) {
+	requestLogger(request).Printf("Unauthorized request.")
+	rw.Header().Set("WWW-Authenticate", "Bearer")
+	sendJSONError(rw, http.StatusUnauthorized, "unauthorized")
+}
+
+// validAPIKey decides whether the token is one of the keys. we compare in
+// constant time so as not to leak how much of a key a guess got right.
+func validAPIKey(keys []string, token string) bool {
+	valid := false
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// maxBytesMiddleware rejects requests with a body larger than limit
+// with a 413. it also requires POST bodies to be json, as all of ours are.
+//
+// we read the body up front so that we can respond with the right status
+// rather than each handler failing part way through decoding. the limit
+// bounds how much we hold in memory.
+func maxBytesMiddleware(limit int64) func(RequestHandlerFunc) RequestHandlerFunc {
+	return func(next RequestHandlerFunc) RequestHandlerFunc {
+		return func(rw http.ResponseWriter, request *http.Request,
+			handler *HttpHandler) {
+			logger := requestLogger(request)
+
+			if request.Method == "POST" {
+				mediaType, _, err := mime.ParseMediaType(
+					request.Header.Get("Content-Type"))
+				if err != nil || mediaType != "application/json" {
+					logger.Printf("Unsupported content type: content_type [%s]",
+						request.Header.Get("Content-Type"))
+					sendJSONError(rw, http.StatusUnsupportedMediaType,
+						"Content-Type must be application/json")
+					return
+				}
+			}
+
+			if request.ContentLength > limit {
+				logger.Printf("Request body too large: content_length [%d]",
+					request.ContentLength)
+				sendJSONError(rw, http.StatusRequestEntityTooLarge,
+					"Request body too large")
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(rw, request.Body, limit))
+			if err != nil {
+				var maxBytesError *http.MaxBytesError
+				if errors.As(err, &maxBytesError) {
+					logger.Printf("Request body too large.")
+					sendJSONError(rw, http.StatusRequestEntityTooLarge,
+						"Request body too large")
+					return
+				}
+				msg := fmt.Sprintf("Failed to read request body: %s", err.Error())
+				logger.Printf(msg)
+				send400Error(rw, msg)
+				return
+			}
+			request.Body = io.NopCloser(bytes.NewReader(body))
+
+			next(rw, request, handler)
+		}
+	}
+}
+
+// timeoutResponseWriter turns a server error caused by the request timing
+// out into a 503.
+type timeoutResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	// set once we have sent the timeout response. we drop anything the
+	// handler writes after that.
+	timedOut bool
+}
+
+// WriteHeader sends a timeout response in place of a server error if the
+// request's deadline passed.
+func (w *timeoutResponseWriter) WriteHeader(status int) {
+	if w.timedOut {
+		return
+	}
+	if status >= 500 && w.ctx.Err() == context.DeadlineExceeded {
+		w.timedOut = true
+		sendJSONError(w.ResponseWriter, http.StatusServiceUnavailable,
+			"request timeout")
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write drops the body if we sent a timeout response.
+func (w *timeoutResponseWriter) Write(b []byte) (int, error) {
+	if w.timedOut {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// timeoutMiddleware gives the request a deadline. handlers pass the
+// request's context to their queries so that they are cancelled once it
+// passes. if the handler then fails, the client gets a 503.
+func timeoutMiddleware(d time.Duration) func(RequestHandlerFunc) RequestHandlerFunc {
+	return func(next RequestHandlerFunc) RequestHandlerFunc {
+		return func(rw http.ResponseWriter, request *http.Request,
+			handler *HttpHandler) {
+			ctx, cancel := context.WithTimeout(request.Context(), d)
+			defer cancel()
+
+			timeoutRW := &timeoutResponseWriter{ResponseWriter: rw, ctx: ctx}
+			next(timeoutRW, request.WithContext(ctx), handler)
+		}
+	}
+}
+
+// corsAllowedHeaders are the request headers we allow in cross-origin
+// requests.
+const corsAllowedHeaders = "Authorization, Content-Type, X-Request-ID"
+
+// corsMiddleware adds CORS headers when the request's origin is one we
+// allow. it also answers preflight (OPTIONS) requests to any path we serve.
+func corsMiddleware(next RequestHandlerFunc) RequestHandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request,
+		handler *HttpHandler) {
+		origins := handler.settings.corsAllowedOrigins()
+		if len(origins) == 0 {
+			next(rw, request, handler)
+			return
+		}
+
+		logger := requestLogger(request)
+		methods := handler.pathMethods(request.URL.Path)
+
+		// our response depends on the origin whether or not we allow it, so
+		// caches must not share it between origins.
+		rw.Header().Add("Vary", "Origin")
+
+		origin := request.Header.Get("Origin")
+		allowOrigin := corsAllowOrigin(origins, origin)
+		if allowOrigin != "" {
+			rw.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			rw.Header().Set("Access-Control-Allow-Methods",
+				strings.Join(append(methods, "OPTIONS"), ", "))
+			rw.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		}
+
+		if request.Method == "OPTIONS" && len(methods) > 0 {
+			logger.Printf("Answering preflight request: origin [%s] allowed [%t]",
+				origin, allowOrigin != "")
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(rw, request, handler)
+	}
+}
+
+// corsAllowOrigin decides the Access-Control-Allow-Origin value for a
+// request from the given origin. it is blank if we do not allow the origin.
+func corsAllowOrigin(allowed []string, origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowedOrigin := range allowed {
+		if allowedOrigin == "*" {
+			return "*"
+		}
+		if allowedOrigin == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// gzipMinBytes is the smallest response body we compress. compressing
+// smaller bodies is not worth the overhead.
+const gzipMinBytes = 1024
+
+// gzipResponseWriter compresses what the handler writes.
+//
+// we hold back the status and the start of the body until we know whether
+// the body reaches gzipMinBytes. if it does not, we send it uncompressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	// status the handler set. 0 if it did not set one.
+	status int
+	// body we have not sent yet, until we decide whether to compress.
+	buf []byte
+	// set once we start compressing.
+	gz *gzip.Writer
+}
+
+// WriteHeader records the status. we send it once we know whether we are
+// compressing.
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write compresses the body once there is enough of it.
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) < gzipMinBytes {
+		return len(b), nil
+	}
+
+	header := w.ResponseWriter.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.statusOrOK())
+
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	_, err := w.gz.Write(w.buf)
+	w.buf = nil
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// statusOrOK is the status to send.
+func (w *gzipResponseWriter) statusOrOK() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// finish sends whatever we are still holding back.
+func (w *gzipResponseWriter) finish() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	if w.status == 0 && len(w.buf) == 0 {
+		return nil
+	}
+	w.ResponseWriter.WriteHeader(w.statusOrOK())
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf)
+	return err
+}
+
+// gzipMiddleware compresses the response when the client accepts gzip and
+// the body is at least gzipMinBytes.
+func gzipMiddleware(next RequestHandlerFunc) RequestHandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request,
+		handler *HttpHandler) {
+		if !strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
+			next(rw, request, handler)
+			return
+		}
+
+		// we take care of compression. make sure the handler does not
+		// compress too.
+		request.Header.Del("Accept-Encoding")
+
+		gzw := &gzipResponseWriter{ResponseWriter: rw}
+		next(gzw, request, handler)
+		err := gzw.finish()
+		if err != nil {
+			requestLogger(request).Printf("Failed to finish response: %s",
+				err.Error())
+		}
+	}
+}
+
+// newRequestID generates a random (version 4) UUID.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:]), nil
+}
+
+// withPathParameters stores the values of the pattern's named groups in
+// the request's context. matches is the result of matching the pattern
+// against the path.
+func withPathParameters(request *http.Request, pattern *regexp.Regexp,
+	matches []string) *http.Request {
+	params := make(map[string]string)
+	for i, name := range pattern.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		params[name] = matches[i]
+	}
+	ctx := context.WithValue(request.Context(), pathParametersKey, params)
+	return request.WithContext(ctx)
+}
+
+// getPathParameter retrieves a parameter from the request's path. it is
+// blank if there is no such parameter.
+func getPathParameter(request *http.Request, name string) string {
+	params, ok := request.Context().Value(pathParametersKey).(map[string]string)
+	if !ok {
+		return ""
+	}
+	return params[name]
+}
+
+// requestLogger finds the logger for the request. if the request has no
+// ID, this is the standard logger.
+func requestLogger(request *http.Request) *log.Logger {
+	logger, ok := request.Context().Value(requestLoggerKey).(*log.Logger)
+	if !ok {
+		return log.Default()
+	}
+	return logger
+}
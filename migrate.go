@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+	"log"
+	"strings"
+)
+
+// migrations holds our schema changes. they are applied in order of their
+// file names, so each starts with a number.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// runMigrations applies any migrations not yet applied to the database. we
+// record the ones we apply in the schema_migrations table, so running this
+// again only applies new ones.
+func runMigrations(db *sql.DB) error {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version VARCHAR PRIMARY KEY,
+	apply_time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT current_timestamp
+)
+`)
+	if err != nil {
+		return err
+	}
+
+	applied, err := retrieveAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	// ReadDir gives us the files sorted by name.
+	entries, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		version := strings.TrimSuffix(entry.Name(), ".sql")
+		if applied[version] {
+			continue
+		}
+
+		contents, err := fs.ReadFile(migrations, "migrations/"+entry.Name())
+		if err != nil {
+			return err
+		}
+		err = applyMigration(db, version, string(contents))
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied migration [%s]", version)
+	}
+	return nil
+}
+
+// retrieveAppliedMigrations finds the versions of the migrations we have
+// applied.
+func retrieveAppliedMigrations(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var version string
+		err := rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs a migration and records it, in a single transaction.
+func applyMigration(db *sql.DB, version string, contents string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(contents)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES($1)`,
+		version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,22 @@
+-- the songs we know about, and each play of one by a user.
+
+CREATE TABLE IF NOT EXISTS song (
+	id SERIAL PRIMARY KEY,
+	artist VARCHAR NOT NULL,
+	album VARCHAR NOT NULL,
+	title VARCHAR NOT NULL,
+	create_time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS play (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	song_id INTEGER NOT NULL REFERENCES song(id),
+	create_time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS play_user_id_create_time_idx
+ON play (user_id, create_time);
+
+CREATE INDEX IF NOT EXISTS play_song_id_idx
+ON play (song_id);
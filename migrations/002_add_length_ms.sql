@@ -0,0 +1,8 @@
+-- songs are identified by their length as well, since the same artist,
+-- album, and title can be different recordings.
+
+ALTER TABLE song ADD COLUMN IF NOT EXISTS length_ms INTEGER NOT NULL
+DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS song_artist_album_title_idx
+ON song (artist, album, title, length_ms);
@@ -0,0 +1,5 @@
+-- the position of a song on its album, so we can list an album's songs in
+-- order. 0 if we do not know it.
+
+ALTER TABLE song ADD COLUMN IF NOT EXISTS track_number INTEGER NOT NULL
+DEFAULT 0;
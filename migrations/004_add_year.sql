@@ -0,0 +1,4 @@
+-- the year a song was released, so we can look at listening by decade. 0 if
+-- we do not know it.
+
+ALTER TABLE song ADD COLUMN IF NOT EXISTS year INTEGER NOT NULL DEFAULT 0;
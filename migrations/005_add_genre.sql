@@ -0,0 +1,4 @@
+-- the genre of a song, so we can find a user's top genres. empty if we do
+-- not know it.
+
+ALTER TABLE song ADD COLUMN IF NOT EXISTS genre VARCHAR NOT NULL DEFAULT '';
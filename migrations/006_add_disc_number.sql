@@ -0,0 +1,6 @@
+-- the disc of its album a song is on. together with the track number this
+-- tells apart songs with the same title on different discs. 0 if we do not
+-- know it.
+
+ALTER TABLE song ADD COLUMN IF NOT EXISTS disc_number INTEGER NOT NULL
+DEFAULT 0;
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofHandlers are the net/http/pprof handlers, under /pprof/. they are
+// for operators, so they require an admin API key.
+//
+// /pprof/ lists the profiles. the others are as in net/http/pprof, such as
+// /pprof/heap, /pprof/goroutine, and /pprof/profile?seconds=30. CPU
+// profiles and traces run for as long as the client asks, so they get a
+// long timeout.
+func pprofHandlers(settings *Config) []RequestHandler {
+	prefix := "^" + settings.UriPrefix + "/pprof/"
+	return []RequestHandler{
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: prefix + "$",
+			Func:        pprofHandler(http.HandlerFunc(pprof.Index)),
+			Admin:       true,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: prefix + "cmdline$",
+			Func:        pprofHandler(http.HandlerFunc(pprof.Cmdline)),
+			Admin:       true,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: prefix + "profile$",
+			Func:        pprofHandler(http.HandlerFunc(pprof.Profile)),
+			Admin:       true,
+			Timeout:     longRequestTimeout,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: prefix + "symbol$",
+			Func:        pprofHandler(http.HandlerFunc(pprof.Symbol)),
+			Admin:       true,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: prefix + "trace$",
+			Func:        pprofHandler(http.HandlerFunc(pprof.Trace)),
+			Admin:       true,
+			Timeout:     longRequestTimeout,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: prefix + "(?P<profile>[a-z]+)$",
+			Func:        handlerPprofProfile,
+			Admin:       true,
+		},
+	}
+}
+
+// pprofHandler adapts a net/http/pprof handler to our handler functions.
+func pprofHandler(h http.Handler) RequestHandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request,
+		handler *HttpHandler) {
+		h.ServeHTTP(rw, request)
+	}
+}
+
+// handlerPprofProfile serves a named profile, such as heap or goroutine.
+// pprof.Index would do this too, but it finds the name from the path
+// assuming a /debug/pprof/ prefix.
+func handlerPprofProfile(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	pprof.Handler(getPathParameter(request, "profile")).ServeHTTP(rw, request)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// recommendationsLimitDefault is how many recommendations we make if no
+// limit is given.
+const recommendationsLimitDefault = 20
+
+// Recommendation is a song we think a user might like.
+type Recommendation struct {
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	Title  string `json:"title"`
+	// how many times the user has played the song's artist. we rank by
+	// this.
+	ArtistPlayCount int64 `json:"artist_play_count"`
+}
+
+// RecommendationsResponse is the body we send in response to a
+// recommendations request.
+type RecommendationsResponse struct {
+	Recommendations []Recommendation `json:"recommendations"`
+}
+
+// getParametersArtistExplore retrieves and validates parameters to an
+// artist explore request.
+// we return: user_id, limit.
+func getParametersArtistExplore(request *http.Request) (int64, int64,
+	error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err := getOptionalLimitParameter(request,
+		recommendationsLimitDefault, recentPlaysLimitMax)
+	if err != nil {
+		return 0, 0, err
+	}
+	logger.Printf("Parameters: user_id [%d] limit [%d]", userId, limit)
+	return userId, limit, nil
+}
+
+// retrieveUnplayedSongs finds songs by artists the given user has played
+// but that the user has never played themselves. we only know of such
+// songs if other users played them, or they were imported.
+//
+// we favour artists the user plays most. we treat a song as played if the
+// user played any song with the same artist and title, since the same
+// song can exist on several albums or with several lengths.
+func retrieveUnplayedSongs(ctx context.Context, db *sql.DB, userId int64,
+	limit int64) ([]Recommendation, error) {
+	defer observeQuery("unplayed_songs", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", userId, limit))
+
+	query := `
+WITH artist_plays AS (
+	SELECT
+	s.artist,
+	COUNT(*) AS play_count
+	FROM play p
+	JOIN song s
+	ON p.song_id = s.id
+	WHERE
+	p.user_id = $1
+	AND s.artist != 'N/A'
+	GROUP BY s.artist
+)
+SELECT
+s.artist,
+s.album,
+s.title,
+a.play_count
+FROM song s
+JOIN artist_plays a
+ON s.artist = a.artist
+WHERE NOT EXISTS (
+	SELECT 1
+	FROM play p
+	JOIN song played
+	ON p.song_id = played.id
+	WHERE
+	p.user_id = $1
+	AND played.artist = s.artist
+	AND played.title = s.title
+)
+GROUP BY s.artist, s.album, s.title, a.play_count
+ORDER BY a.play_count DESC, s.artist, s.album, s.title
+LIMIT $2
+`
+	rows, err := db.QueryContext(ctx, query, userId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recommendations := []Recommendation{}
+	for rows.Next() {
+		var recommendation Recommendation
+		err := rows.Scan(&recommendation.Artist, &recommendation.Album,
+			&recommendation.Title, &recommendation.ArtistPlayCount)
+		if err != nil {
+			return nil, err
+		}
+		recommendations = append(recommendations, recommendation)
+	}
+	return recommendations, rows.Err()
+}
+
+// handlerArtistExplore recommends unplayed songs by artists a user
+// listens to.
+func handlerArtistExplore(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, limit, err := getParametersArtistExplore(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	recommendations, err := retrieveUnplayedSongs(request.Context(),
+		handler.db, userId, limit)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve recommendations: %s",
+			err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK,
+		RecommendationsResponse{Recommendations: recommendations})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// reloadOnSignal reloads our config each time we receive SIGHUP, until
+// the context is done. if a reload fails we keep the config we have.
+func (server *Server) reloadOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Print("Received SIGHUP. Reloading config.")
+			err := server.reloadConfig()
+			if err != nil {
+				log.Printf("Failed to reload config. Keeping the current config: %s",
+					err.Error())
+				continue
+			}
+			log.Print("Reloaded config.")
+		}
+	}
+}
+
+// reloadConfig reads our config file again and starts using it. requests
+// in flight finish with the config they started with.
+//
+// we open a new database connection pool only if the connection settings
+// changed. otherwise we apply any new pool settings to the pool we have.
+// pool settings that are no longer set keep their current values.
+//
+// the listen address, serve mode, TLS files, cache TTL, and slow query
+// threshold only take effect on restart.
+func (server *Server) reloadConfig() error {
+	settings, err := loadConfig(server.configPath)
+	if err != nil {
+		return err
+	}
+
+	handlers, err := compileHandlers(getHandlers(settings))
+	if err != nil {
+		return err
+	}
+
+	current := server.state.Load()
+	warnRestartSettings(current.settings, settings)
+
+	db := current.db
+	if dbSettingsChanged(current.settings, settings) {
+		db, err = connectToDb(settings)
+		if err != nil {
+			return err
+		}
+		// we check the new settings work before we give up the old ones.
+		ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+		err = db.PingContext(ctx)
+		cancel()
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("Unable to connect to the database: %s",
+				err.Error())
+		}
+		log.Print("Database connection settings changed. Using a new pool.")
+	}
+	configureDbPool(db, settings)
+
+	if len(settings.apiKeys()) == 0 {
+		log.Printf("Warning: No APIKeys set. Requests are not authenticated.")
+	}
+
+	server.state.Store(&serverState{
+		settings: settings,
+		db:       db,
+		handlers: handlers,
+	})
+
+	if db != current.db {
+		go closeDbLater(current.db, longRequestTimeout)
+	}
+	return nil
+}
+
+// dbSettingsChanged decides whether we need a new database connection
+// pool to use the new settings.
+func dbSettingsChanged(current *Config, updated *Config) bool {
+	return current.DbUser != updated.DbUser ||
+		current.DbPass != updated.DbPass ||
+		current.DbName != updated.DbName ||
+		current.DbHost != updated.DbHost ||
+		current.DbPort != updated.DbPort
+}
+
+// warnRestartSettings logs about any settings that changed that we do not
+// apply until we restart.
+func warnRestartSettings(current *Config, updated *Config) {
+	if current.ListenHost != updated.ListenHost ||
+		current.ListenPort != updated.ListenPort ||
+		current.ListenSocket != updated.ListenSocket {
+		log.Print("Warning: ListenHost, ListenPort, and ListenSocket changes require a restart.")
+	}
+	if current.ServeMode != updated.ServeMode ||
+		current.TLSCertFile != updated.TLSCertFile ||
+		current.TLSKeyFile != updated.TLSKeyFile {
+		log.Print("Warning: ServeMode, TLSCertFile, and TLSKeyFile changes require a restart.")
+	}
+	if current.CacheTTLSeconds != updated.CacheTTLSeconds {
+		log.Print("Warning: CacheTTLSeconds changes require a restart.")
+	}
+	if current.SlowQueryThresholdMs != updated.SlowQueryThresholdMs {
+		log.Print("Warning: SlowQueryThresholdMs changes require a restart.")
+	}
+}
+
+// closeDbLater closes a database connection pool we replaced once requests
+// that were using it must be done.
+func closeDbLater(db *sql.DB, wait time.Duration) {
+	time.Sleep(wait)
+	err := db.Close()
+	if err != nil {
+		log.Printf("Failed to close old database connection: %s", err.Error())
+		return
+	}
+	log.Print("Closed old database connection pool.")
+}
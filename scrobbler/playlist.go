@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parsem3u reads an M3U or M3U8 playlist and returns the absolute paths of
+// the files in it.
+// relative paths are relative to the directory the playlist is in. we skip
+// lines starting with '#' (comments and extended M3U directives), and any
+// file that does not exist.
+func parsem3u(path string) ([]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		// M3U8 files may start with a byte order mark.
+		line := strings.TrimPrefix(scanner.Text(), "\ufeff")
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		file := line
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+
+		_, err := os.Stat(file)
+		if err != nil {
+			log.Printf("Warning: Skipping playlist entry: %s", err.Error())
+			continue
+		}
+
+		files = append(files, file)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
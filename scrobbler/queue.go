@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/horgh/song_tracker2/client"
+)
+
+// QueuedPlay is a play we failed to record. we keep these in the queue
+// file, one json object per line, and try them again on the next run.
+type QueuedPlay struct {
+	Artist        string    `json:"artist"`
+	Album         string    `json:"album"`
+	Title         string    `json:"title"`
+	LengthSeconds int       `json:"length"`
+	DiscNumber    int       `json:"disc,omitempty"`
+	TrackNumber   int       `json:"track,omitempty"`
+	Year          int       `json:"year,omitempty"`
+	Genre         string    `json:"genre,omitempty"`
+	Time          time.Time `json:"time"`
+	// the submit targets we still need to record the play to. empty means
+	// all of the configured ones.
+	Targets []string `json:"targets,omitempty"`
+}
+
+// defaultQueuePath finds the queue file to use if none is given.
+func defaultQueuePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".song_tracker_queue"
+	}
+	return filepath.Join(home, ".song_tracker_queue")
+}
+
+// lockQueue takes an exclusive lock on the queue file, waiting for it if
+// another run has it. we lock a separate file since we replace the queue
+// file when we flush it. we return a function to release the lock.
+//
+// we run once per track, so runs can overlap. without the lock, a play
+// queued while another run flushes could be lost, and two runs flushing
+// at once would record the same plays twice.
+func lockQueue(path string) (func(), error) {
+	fh, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("Unable to lock queue: %s", err.Error())
+	}
+
+	return func() {
+		err := syscall.Flock(int(fh.Fd()), syscall.LOCK_UN)
+		if err != nil {
+			log.Printf("Failed to unlock queue: %s", err.Error())
+		}
+		fh.Close()
+	}, nil
+}
+
+// queuePlay appends a play to the queue file, to be recorded to the given
+// targets.
+func queuePlay(path string, tags *client.Tags, playTime time.Time,
+	targets []string) error {
+	unlock, err := lockQueue(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	play := QueuedPlay{
+		Artist:        tags.Artist,
+		Album:         tags.Album,
+		Title:         tags.Title,
+		LengthSeconds: tags.LengthSeconds,
+		DiscNumber:    tags.DiscNumber,
+		TrackNumber:   tags.TrackNumber,
+		Year:          tags.Year,
+		Genre:         tags.Genre,
+		Time:          playTime,
+		Targets:       targets,
+	}
+	b, err := json.Marshal(play)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fh.Write(append(b, '\n'))
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// loadQueue reads the plays in the queue file. it is not an error for the
+// file to not exist.
+func loadQueue(path string) ([]QueuedPlay, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fh.Close()
+
+	var plays []QueuedPlay
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var play QueuedPlay
+		err := json.Unmarshal(line, &play)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid queue line: %s: %s", line, err.Error())
+		}
+		plays = append(plays, play)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return plays, nil
+}
+
+// flushQueue tries to record each play in the queue file. we remove the
+// plays we record from the file and keep those that still fail. we hold
+// the queue lock throughout.
+func flushQueue(config *client.Config, path string) error {
+	unlock, err := lockQueue(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	plays, err := loadQueue(path)
+	if err != nil {
+		return err
+	}
+	if len(plays) == 0 {
+		return nil
+	}
+	log.Printf("Recording %d queued play(s)", len(plays))
+
+	var remaining []QueuedPlay
+	for _, play := range plays {
+		targets := pendingTargets(config, play.Targets)
+		if len(targets) == 0 {
+			log.Printf("Dropping queued play from %s: Its targets %v are no longer configured",
+				play.Time.Format(time.RFC3339), play.Targets)
+			continue
+		}
+
+		// NOTE: the song tracker API records plays at the time it receives
+		//   them, so there the original time is only kept for reference.
+		log.Printf("Recording queued play from %s", play.Time.Format(time.RFC3339))
+		failedTargets, err := client.RecordPlayAt(config, &client.Tags{
+			Artist:        play.Artist,
+			Album:         play.Album,
+			Title:         play.Title,
+			LengthSeconds: play.LengthSeconds,
+			DiscNumber:    play.DiscNumber,
+			TrackNumber:   play.TrackNumber,
+			Year:          play.Year,
+			Genre:         play.Genre,
+		}, play.Time, targets)
+		if err != nil {
+			log.Printf("Failed to record queued play: %s", err.Error())
+			play.Targets = failedTargets
+			remaining = append(remaining, play)
+		}
+	}
+
+	return rewriteQueue(path, remaining)
+}
+
+// pendingTargets finds which of the targets a queued play still needs
+// recording to that we are configured to submit to. if the play does not
+// say, that is all of them.
+func pendingTargets(config *client.Config, queued []string) []string {
+	configured := config.Targets()
+	if len(queued) == 0 {
+		return configured
+	}
+
+	var targets []string
+	for _, target := range queued {
+		for _, configuredTarget := range configured {
+			if target == configuredTarget {
+				targets = append(targets, target)
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// rewriteQueue replaces the queue file with the given plays. if there are
+// none, we remove the file.
+func rewriteQueue(path string, plays []QueuedPlay) error {
+	if len(plays) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	// write to a temporary file and rename it over the queue so that we do
+	// not lose plays if we fail partway.
+	tmpPath := path + ".tmp"
+	fh, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	for _, play := range plays {
+		b, err := json.Marshal(play)
+		if err != nil {
+			fh.Close()
+			return err
+		}
+		_, err = fh.Write(append(b, '\n'))
+		if err != nil {
+			fh.Close()
+			return err
+		}
+	}
+
+	err = fh.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
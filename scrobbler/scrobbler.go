@@ -6,15 +6,37 @@
  * the intention is this can then be used together with any audio
  * player to scrobble with.
  * in particular I want to be able to call it together with mplayer.
+ *
+ * the configuration file and audio file may also be given by the
+ * SONG_TRACKER_CONFIG and SONG_TRACKER_FILE environment variables. this is
+ * convenient when we are run by a player's hook.
+ *
+ * if we fail to record a play, we add it to a queue file and try again the
+ * next time we run.
+ *
+ * if we are told how long the song was listened to, we only record it if
+ * that was long enough, in the way Last.fm does.
+ *
+ * some players' hooks run when a song starts. for those we can sleep
+ * before recording, such as until partway through the song.
+ *
+ * to debug a setup, -config-check shows the configuration we would use and
+ * checks we can reach the server, without recording anything.
  */
 
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/horgh/song_tracker2/client"
 )
@@ -24,8 +46,48 @@ type Args struct {
 	// Config is path to a configuration file.
 	Config string
 
-	// File is path to the audio file.
-	File string
+	// Files are paths to the audio files.
+	Files []string
+
+	// Queue is path to the file holding plays we failed to record.
+	Queue string
+
+	// DryRun means we show the tags we would record rather than recording.
+	DryRun bool
+
+	// MinPercent is how much of a song must be listened to for us to record
+	// it.
+	MinPercent int
+
+	// ListenSeconds is how long the song was listened to. -1 if we do not
+	// know, in which case we always record it.
+	ListenSeconds int
+
+	// Sleep is how many seconds to wait before recording. -1 means wait
+	// until MinPercent of the way through the song.
+	Sleep int
+
+	// CheckOnly means we check the configuration rather than recording.
+	// only Config is set.
+	CheckOnly bool
+}
+
+// fullListenSeconds is how long a listen counts as enough no matter the
+// song's length, as with Last.fm.
+const fullListenSeconds = 4 * 60
+
+// fileList collects the values of a flag that may be given several times.
+type fileList []string
+
+// String is part of the flag.Value interface
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set is part of the flag.Value interface
+func (f *fileList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 // main is the program entry
@@ -40,28 +102,280 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = client.ExtractAndRecord(args.Config, args.File)
+	if args.CheckOnly {
+		if !checkConfig(args.Config) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args.DryRun {
+		failed := false
+		for _, file := range args.Files {
+			err := showTags(file)
+			if err != nil {
+				log.Printf("%s: %s", file, err.Error())
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	config, err := client.ParseConfig(args.Config)
 	if err != nil {
 		log.Print(err.Error())
 		os.Exit(1)
 	}
+
+	// try to catch up on plays we failed to record before.
+	err = flushQueue(config, args.Queue)
+	if err != nil {
+		log.Printf("Failed to flush queue: %s", err.Error())
+	}
+
+	// an interrupt stops us recording any more files, including cutting
+	// short a sleep before recording.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// record each file. we carry on if one fails.
+	failed := false
+	for i, file := range args.Files {
+		if ctx.Err() != nil {
+			log.Printf("Interrupted. Not recording %d remaining file(s)",
+				len(args.Files)-i)
+			failed = true
+			break
+		}
+		err := recordFile(ctx, config, file, args)
+		if err != nil {
+			log.Printf("%s: %s", file, err.Error())
+			failed = true
+		}
+	}
+
+	if failed {
+		stop()
+		os.Exit(1)
+	}
+}
+
+// recordFile extracts the tags from an audio file and records a play of
+// it. if recording fails, we queue the play to retry later.
+//
+// if the song was not listened to for long enough, we skip it. this is not
+// an error.
+//
+// if we are to sleep first, we do so before recording. if the context is
+// cancelled while we sleep, we do not record.
+func recordFile(ctx context.Context, config *client.Config, file string,
+	args *Args) error {
+	tags, err := client.ExtractTags(file)
+	if err != nil {
+		return err
+	}
+
+	if !listenedEnough(tags, args) {
+		log.Printf("Warning: %s: Listened to %d of %d seconds, less than %d%%. Not recording",
+			file, args.ListenSeconds, tags.LengthSeconds, args.MinPercent)
+		return nil
+	}
+
+	sleep := sleepDuration(tags, args)
+	if sleep > 0 {
+		log.Printf("Waiting %s before recording", sleep)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return errors.New("Interrupted. Not recording")
+		}
+	}
+	playTime := time.Now()
+
+	// we queue the play only for the targets we failed to record it to, so
+	// that we do not record it twice to the others.
+	failedTargets, err := client.RecordPlayAt(config, tags, playTime,
+		config.Targets())
+	if err != nil {
+		queueErr := queuePlay(args.Queue, tags, playTime, failedTargets)
+		if queueErr != nil {
+			log.Printf("Failed to queue play: %s", queueErr.Error())
+		} else {
+			log.Printf("Queued play to retry later")
+		}
+		return err
+	}
+	return nil
+}
+
+// listenedEnough decides whether the song was listened to for long enough
+// to record. it was if we listened to at least the minimum percent of it,
+// or for fullListenSeconds. if we do not know how long we listened, or how
+// long the song is, we say it was.
+func listenedEnough(tags *client.Tags, args *Args) bool {
+	if args.ListenSeconds == -1 || tags.LengthSeconds <= 0 {
+		return true
+	}
+	if args.ListenSeconds >= fullListenSeconds {
+		return true
+	}
+	return args.ListenSeconds*100/tags.LengthSeconds >= args.MinPercent
+}
+
+// sleepDuration is how long to wait before recording the song.
+func sleepDuration(tags *client.Tags, args *Args) time.Duration {
+	if args.Sleep == -1 {
+		return time.Duration(tags.LengthSeconds*args.MinPercent/100) *
+			time.Second
+	}
+	return time.Duration(args.Sleep) * time.Second
+}
+
+// checkConfig parses the configuration file and shows what we found. we
+// hide secrets. if we record to the song tracker, we check we can reach
+// it. we say whether everything looks valid.
+func checkConfig(path string) bool {
+	config, err := client.ParseConfig(path)
+	if err != nil {
+		log.Printf("Invalid configuration: %s", err.Error())
+		return false
+	}
+
+	fmt.Printf("username = %s\n", config.Username)
+	fmt.Printf("password = %s\n", mask(config.Password))
+	fmt.Printf("url = %s\n", config.URL)
+	fmt.Printf("debug = %s\n", config.Debug)
+	fmt.Printf("timeout_seconds = %d\n", config.TimeoutSeconds)
+	fmt.Printf("tls_verify = %t\n", config.TLSVerify)
+	fmt.Printf("max_retries = %d\n", config.MaxRetries)
+	fmt.Printf("retry_base_delay_ms = %d\n", config.RetryBaseDelayMs)
+	fmt.Printf("submit_target = %s\n", config.SubmitTarget)
+	fmt.Printf("listenbrainz_token = %s\n", mask(config.ListenBrainzToken))
+
+	if config.SubmitTarget == "listenbrainz" {
+		log.Printf("Configuration looks valid")
+		return true
+	}
+
+	status, err := client.CheckURL(config)
+	if err != nil {
+		log.Printf("Unable to reach %s: %s", config.URL, err.Error())
+		return false
+	}
+	log.Printf("Reached %s (HTTP code %d)", config.URL, status)
+	log.Printf("Configuration looks valid")
+	return true
+}
+
+// mask hides a secret, showing only whether it is set.
+func mask(secret string) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	return "***"
+}
+
+// showTags extracts the tags from an audio file and prints them.
+func showTags(file string) error {
+	tags, err := client.ExtractTags(file)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(tags, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
 }
 
 // getArgs retrieves and validates command line arguments
 func getArgs() (*Args, error) {
-	config := flag.String("config", "", "Path to the configuration file")
-	file := flag.String("file", "", "Path to the audio file")
+	config := flag.String("config", "",
+		"Path to the configuration file. Defaults to $SONG_TRACKER_CONFIG")
+	var files fileList
+	flag.Var(&files, "file",
+		"Path to an audio file. Give this more than once to record several plays. Defaults to $SONG_TRACKER_FILE")
+	queue := flag.String("queue", defaultQueuePath(),
+		"Path to the file holding plays we failed to record")
+	playlist := flag.String("playlist", "",
+		"Path to an M3U playlist. We record a play of each file in it")
+	dryRun := flag.Bool("dry-run", false,
+		"Show the tags we would record rather than recording a play")
+	minPercent := flag.Int("min-percent", 50,
+		"Percent of a song that must be listened to for us to record it. Used with -listen-seconds")
+	sleep := flag.Int("sleep", 0,
+		"Seconds to wait before recording. Give -1 to wait until -min-percent of the way through the song")
+	configCheck := flag.Bool("config-check", false,
+		"Check the configuration file and that we can reach the server, then exit. We record nothing")
+	listenSeconds := flag.Int("listen-seconds", -1,
+		"How many seconds the song was listened to. If given, we only record it if this is at least -min-percent of the song, or 4 minutes")
 
 	flag.Parse()
 
+	// flags take precedence over the environment.
 	if len(*config) == 0 {
+		*config = os.Getenv("SONG_TRACKER_CONFIG")
+	}
+
+	// we need nothing else to check the configuration.
+	if *configCheck {
+		if len(*config) == 0 {
+			return nil, errors.New("You must specify a configuration file")
+		}
+		return &Args{
+			Config:    *config,
+			CheckOnly: true,
+		}, nil
+	}
+	if len(files) == 0 && len(*playlist) == 0 {
+		if file := os.Getenv("SONG_TRACKER_FILE"); len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+
+	// we do not need a configuration file if we are not recording.
+	if len(*config) == 0 && !*dryRun {
 		return nil, errors.New("You must specify a configuration file")
 	}
-	if len(*file) == 0 {
-		return nil, errors.New("You must specify a file")
+	if len(*playlist) > 0 {
+		playlistFiles, err := parsem3u(*playlist)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read playlist: %s", err.Error())
+		}
+		files = append(files, playlistFiles...)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("You must specify a file or a playlist")
+	}
+	if len(*queue) == 0 {
+		return nil, errors.New("You must specify a queue file")
+	}
+	if *minPercent < 0 || *minPercent > 100 {
+		return nil, errors.New("Minimum percent must be between 0 and 100")
+	}
+	if *listenSeconds < -1 {
+		return nil, errors.New("Listen seconds must not be negative")
+	}
+	if *sleep < -1 {
+		return nil, errors.New("Sleep must not be negative")
 	}
 
 	// TODO: check files exist and are readable
 
-	return &Args{Config: *config, File: *file}, nil
+	return &Args{
+		Config: *config,
+		Files:  files,
+		Queue:  *queue,
+		DryRun: *dryRun,
+
+		MinPercent:    *minPercent,
+		ListenSeconds: *listenSeconds,
+		Sleep:         *sleep,
+	}, nil
 }
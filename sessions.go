@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sessionGapMinutesDefault is the longest gap between plays in a session if
+// the request does not say.
+const sessionGapMinutesDefault = 30
+
+// sessionGapMinutesMax is the longest gap between plays in a session a
+// request may ask for.
+const sessionGapMinutesMax = 24 * 60
+
+// sessionsLimitDefault is how many sessions we respond with if no limit is
+// given.
+const sessionsLimitDefault = 100
+
+// sessionsLimitMax is the most sessions we respond with.
+const sessionsLimitMax = 1000
+
+// topSessionsLimitDefault is how many sessions we respond with for a top
+// sessions request if no limit is given.
+const topSessionsLimitDefault = 10
+
+// topSessionsLimitMax is the most sessions we respond with for a top
+// sessions request.
+const topSessionsLimitMax = 100
+
+// sessionPlaysCTE is a common table expression, session_plays, splitting
+// the user's plays into sessions. a play more than the gap after the one
+// before it starts a new session. its columns are: play_id, song_id,
+// create_time, length_ms, and session_id. session IDs count up from 1 in
+// order of time.
+//
+// both windows order plays by time then ID. plays recorded together share
+// a time, and ordering them differently would split them into sessions.
+//
+// its parameters are: $1 the user, $2 the days back interval, $3 the gap
+// interval.
+const sessionPlaysCTE = `
+WITH plays AS (
+	SELECT
+	p.id AS play_id,
+	p.song_id,
+	p.create_time,
+	s.length_ms,
+	CASE
+		WHEN p.create_time - LAG(p.create_time) OVER (
+			ORDER BY p.create_time, p.id
+		) <= CAST($3 AS INTERVAL)
+		THEN 0
+		ELSE 1
+	END AS new_session
+	FROM play p
+	JOIN song s
+	ON p.song_id = s.id
+	WHERE
+	p.user_id = $1
+	AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+),
+session_plays AS (
+	SELECT
+	play_id,
+	song_id,
+	create_time,
+	length_ms,
+	SUM(new_session) OVER (
+		ORDER BY create_time, play_id
+		ROWS UNBOUNDED PRECEDING
+	) AS session_id
+	FROM plays
+)
+`
+
+// SessionsParameters holds the parameters to a sessions request.
+type SessionsParameters struct {
+	UserId int64
+	// -1 means all time.
+	DaysBack   int64
+	GapMinutes int64
+	Limit      int64
+}
+
+// Session is a stretch of continuous listening.
+type Session struct {
+	// RFC3339. when the first and last plays were.
+	SessionStart string `json:"session_start"`
+	SessionEnd   string `json:"session_end"`
+	PlayCount    int64  `json:"play_count"`
+	// the lengths of the session's songs added up.
+	TotalDurationMs int64 `json:"total_duration_ms"`
+}
+
+// SessionsResponse is the body we send in response to a sessions request.
+type SessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// TopSessionResult is one of a user's longest sessions.
+type TopSessionResult struct {
+	Session
+	// the song played most in the session, as "artist - title". ties go to
+	// the song played first.
+	TopSong          string `json:"top_song"`
+	TopSongPlayCount int64  `json:"top_song_play_count"`
+}
+
+// TopSessionsResponse is the body we send in response to a top sessions
+// request.
+type TopSessionsResponse struct {
+	Sessions []TopSessionResult `json:"sessions"`
+}
+
+// getParametersSessions retrieves and validates parameters to a sessions
+// or top sessions request. limitDefault and limitMax are for the limit
+// parameter.
+func getParametersSessions(request *http.Request, limitDefault int64,
+	limitMax int64) (*SessionsParameters, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	daysBack, err := getDaysBackParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	gapMinutes, err := getOptionalIntParameter(request, "session_gap_minutes",
+		sessionGapMinutesDefault, 1, sessionGapMinutesMax)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := getOptionalLimitParameter(request, limitDefault, limitMax)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Parameters: user_id [%d] days_back [%d] session_gap_minutes [%d] limit [%d]",
+		userId, daysBack, gapMinutes, limit)
+	return &SessionsParameters{
+		UserId:     userId,
+		DaysBack:   daysBack,
+		GapMinutes: gapMinutes,
+		Limit:      limit,
+	}, nil
+}
+
+// sessionGapInterval is the interval for the gap between plays in a
+// session, for the session queries.
+func sessionGapInterval(gapMinutes int64) string {
+	return fmt.Sprintf("%d minutes", gapMinutes)
+}
+
+// retrieveSessions finds the given user's listening sessions over the
+// given number of days back, newest first. if days back is -1, we look at
+// all time.
+//
+// a session is a run of plays where no play is more than the gap after the
+// one before it.
+func retrieveSessions(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64, gapMinutes int64, limit int64) ([]Session, error) {
+	defer observeQuery("sessions", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", userId, limit))
+
+	query := sessionPlaysCTE + `
+SELECT
+MIN(create_time) AS session_start,
+MAX(create_time) AS session_end,
+COUNT(*) AS play_count,
+SUM(length_ms) AS total_duration_ms
+FROM session_plays
+GROUP BY session_id
+ORDER BY session_start DESC
+LIMIT $4
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		daysBackInterval(daysBack), sessionGapInterval(gapMinutes), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		var start, end time.Time
+		err := rows.Scan(&start, &end, &session.PlayCount,
+			&session.TotalDurationMs)
+		if err != nil {
+			return nil, err
+		}
+		session.SessionStart = start.Format(time.RFC3339)
+		session.SessionEnd = end.Format(time.RFC3339)
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// handlerSessionGroups looks up a user's listening sessions.
+func handlerSessionGroups(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersSessions(request, sessionsLimitDefault,
+		sessionsLimitMax)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	sessions, err := retrieveSessions(request.Context(), handler.db,
+		params.UserId, params.DaysBack, params.GapMinutes, params.Limit)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve sessions: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK,
+		SessionsResponse{Sessions: sessions})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// retrieveTopSessions finds the given user's longest listening sessions
+// over the given number of days back, longest first. if days back is -1,
+// we look at all time. a session's length is the lengths of its songs
+// added up. sessions are as retrieveSessions finds them.
+func retrieveTopSessions(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64, gapMinutes int64,
+	limit int64) ([]TopSessionResult, error) {
+	defer observeQuery("top_sessions", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", userId, limit))
+
+	query := sessionPlaysCTE + `,
+sessions AS (
+	SELECT
+	session_id,
+	MIN(create_time) AS session_start,
+	MAX(create_time) AS session_end,
+	COUNT(*) AS play_count,
+	SUM(length_ms) AS total_duration_ms
+	FROM session_plays
+	GROUP BY session_id
+	ORDER BY total_duration_ms DESC, session_start DESC
+	LIMIT $4
+),
+session_songs AS (
+	SELECT
+	sp.session_id,
+	CONCAT(s.artist, ' - ', s.title) AS label,
+	COUNT(*) AS play_count,
+	ROW_NUMBER() OVER (
+		PARTITION BY sp.session_id
+		ORDER BY COUNT(*) DESC, MIN(sp.create_time)
+	) AS rank
+	FROM session_plays sp
+	JOIN sessions t
+	ON sp.session_id = t.session_id
+	JOIN song s
+	ON sp.song_id = s.id
+	GROUP BY sp.session_id, s.artist, s.title
+)
+SELECT
+t.session_start,
+t.session_end,
+t.play_count,
+t.total_duration_ms,
+ss.label,
+ss.play_count
+FROM sessions t
+JOIN session_songs ss
+ON ss.session_id = t.session_id
+AND ss.rank = 1
+ORDER BY t.total_duration_ms DESC, t.session_start DESC
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		daysBackInterval(daysBack), sessionGapInterval(gapMinutes), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []TopSessionResult{}
+	for rows.Next() {
+		var session TopSessionResult
+		var start, end time.Time
+		err := rows.Scan(&start, &end, &session.PlayCount,
+			&session.TotalDurationMs, &session.TopSong, &session.TopSongPlayCount)
+		if err != nil {
+			return nil, err
+		}
+		session.SessionStart = start.Format(time.RFC3339)
+		session.SessionEnd = end.Format(time.RFC3339)
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// handlerTopSessions looks up a user's longest listening sessions.
+func handlerTopSessions(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersSessions(request, topSessionsLimitDefault,
+		topSessionsLimitMax)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	sessions, err := retrieveTopSessions(request.Context(), handler.db,
+		params.UserId, params.DaysBack, params.GapMinutes, params.Limit)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top sessions: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK,
+		TopSessionsResponse{Sessions: sessions})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
@@ -2,25 +2,33 @@
  * provide aspects of functionality relating to my song_tracker project.
  * I intend to move some/all of the functionality from PHP to Go.
  *
- * TODO:
- * - all 'api' type requests should always respond with json - even errors.
+ * all 'api' type requests respond with json - even errors.
  */
 
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/fcgi"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/horgh/config"
 	_ "github.com/lib/pq"
@@ -36,25 +44,115 @@ type Config struct {
 	DbHost     string
 	DbPort     uint64
 	UriPrefix  string
+	// a unix socket to listen on instead of ListenHost and ListenPort.
+	ListenSocket string
+	// how we serve requests: fcgi (behind a web server) or http.
+	ServeMode string
+	// with ServeMode http, if both are set we serve HTTPS using this
+	// certificate and key (PEM).
+	TLSCertFile string
+	TLSKeyFile  string
+	// database connection pool settings. zero means use the database/sql
+	// default.
+	DbMaxOpenConns           uint64
+	DbMaxIdleConns           uint64
+	DbConnMaxLifetimeSeconds uint64
+	DbConnMaxIdleTimeSeconds uint64
+	// how long we wait for in-flight requests to finish when shutting down.
+	ShutdownTimeoutSeconds uint64
+	// the maximum number of 'top' results we respond to.
+	TopLimitMax uint64
+	// origins we allow cross-origin requests from, space separated. * allows
+	// any origin. blank means we do not send CORS headers.
+	CORSAllowedOrigins string
+	// bearer tokens clients may authenticate with, space separated. blank
+	// means we do not require authentication.
+	APIKeys string
+	// bearer tokens for admin requests, such as ones across all users,
+	// space separated. blank means admin requests are refused.
+	AdminAPIKeys string
+	// the largest request body we accept.
+	MaxRequestBodyBytes uint64
+	// how long a request may run before we give up on it. handlers may
+	// override this.
+	QueryTimeoutSeconds uint64
+	// how long we cache top results for. 0 means we do not cache.
+	CacheTTLSeconds uint64
+	// queries taking longer than this many milliseconds are logged as slow.
+	SlowQueryThresholdMs uint64
+	// a play of the same song by the same user within this many seconds of
+	// another is taken to be a duplicate, and not recorded.
+	DuplicateWindowSeconds uint64
+	// whether to serve net/http/pprof profiles under /pprof/. they require
+	// an admin API key.
+	EnablePprof bool
 }
 
-// HttpHandler is an object implementing the http.Handler interface
-// for serving requests.
+// HttpHandler holds what we need to service a request. the Server makes
+// one for each request from its current state, so a config reload does
+// not change it while the request is in flight.
 type HttpHandler struct {
 	settings *Config
+	// database connection pool.
+	// NOTE: according to the database/sql documentation, the DB type
+	//   is indeed safe for concurrent use by multiple goroutines.
+	db *sql.DB
+	// the requests we service. their patterns are compiled.
+	handlers []RequestHandler
+	// recent top results.
+	cache *Cache
+}
+
+// Server is an object implementing the http.Handler interface for serving
+// requests. we can replace its config while running. see reloadConfig().
+type Server struct {
+	// where we read our config from, so we can read it again.
+	configPath string
+	// the config, database connection pool, and handlers requests use. we
+	// replace them together when we reload.
+	state atomic.Pointer[serverState]
+	// tracks requests currently being served so we can wait for them
+	// during shutdown.
+	inFlight *sync.WaitGroup
+	// set once we start waiting on inFlight during shutdown. after that we
+	// refuse requests, since we may be about to close the database. the
+	// mutex makes sure we do not add to inFlight while we wait on it.
+	shutdownMutex sync.RWMutex
+	shuttingDown  bool
+	// recent top results. we keep these across reloads.
+	cache *Cache
+}
+
+// serverState is what a Server replaces when it reloads its config.
+type serverState struct {
+	settings *Config
+	db       *sql.DB
+	handlers []RequestHandler
 }
 
 // RequestHandlerFunc is a function that services a specific request.
 type RequestHandlerFunc func(http.ResponseWriter, *http.Request,
-	*Config)
+	*HttpHandler)
 
 // RequestHandler defines requests we service.
 type RequestHandler struct {
 	Method string
-	// regex patter on the path to match.
+	// regex patter on the path to match. named groups (e.g.
+	// (?P<play_id>[0-9]+)) become path parameters.
 	PathPattern string
 	// handler function.
 	Func RequestHandlerFunc
+	// whether to leave requests to this handler out of our metrics.
+	SkipMetrics bool
+	// whether clients may use this handler without authenticating.
+	Public bool
+	// whether clients must authenticate with an admin API key.
+	Admin bool
+	// how long requests to this handler may run. 0 means use the
+	// QueryTimeoutSeconds setting.
+	Timeout time.Duration
+	// PathPattern compiled. we set this at startup with compileHandlers().
+	compiledPattern *regexp.Regexp
 }
 
 // TopResult holds row data for a 'top artist' or 'top song' request.
@@ -63,14 +161,253 @@ type TopResult struct {
 	Label string
 }
 
-// global db connection.
-// this is so we try to share a single connection for multiple requests.
-// NOTE: according to the database/sql documentation, the DB type
-//   is indeed safe for concurrent use by multiple goroutines.
-var Db *sql.DB
+// HealthResponse is the body we send in response to a health check.
+type HealthResponse struct {
+	Status string `json:"status"`
+	Db     string `json:"db"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RecentPlay holds a single play for a 'recent plays' request. the year
+// is the year the song was released, or 0 if we do not know it.
+type RecentPlay struct {
+	// clients can use this to delete the play (DELETE /plays/{id}).
+	PlayId     int64  `json:"play_id"`
+	Artist     string `json:"artist"`
+	Album      string `json:"album"`
+	Title      string `json:"title"`
+	LengthMs   int64  `json:"length_ms"`
+	Year       int64  `json:"year"`
+	CreateTime string `json:"create_time"`
+}
+
+// TotalPlaysResponse is the body we send for a total plays request.
+type TotalPlaysResponse struct {
+	UserId     int64 `json:"user_id"`
+	TotalPlays int64 `json:"total_plays"`
+}
+
+// RecordPlayRequest is the body of a request to record a play.
+type RecordPlayRequest struct {
+	UserId   int64  `json:"user_id"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Title    string `json:"title"`
+	LengthMs int64  `json:"length_ms"`
+	// optional. 0 if unknown.
+	DiscNumber int64 `json:"disc_number"`
+	// optional. 0 if unknown.
+	TrackNumber int64 `json:"track_number"`
+	// optional. the year the song was released. 0 if unknown.
+	Year int64 `json:"year"`
+	// optional.
+	Genre string `json:"genre"`
+}
+
+// songYearMax is the latest release year we accept.
+const songYearMax = 9999
+
+// SongDetails describes the song a play is of.
+type SongDetails struct {
+	Artist   string
+	Album    string
+	Title    string
+	LengthMs int64
+	// 0 if unknown.
+	DiscNumber int64
+	// 0 if unknown.
+	TrackNumber int64
+	// 0 if unknown.
+	Year int64
+	// empty if unknown.
+	Genre string
+}
+
+// song gives the details of the song the play is of.
+func (params *RecordPlayRequest) song() *SongDetails {
+	return &SongDetails{
+		Artist:      params.Artist,
+		Album:       params.Album,
+		Title:       params.Title,
+		LengthMs:    params.LengthMs,
+		DiscNumber:  params.DiscNumber,
+		TrackNumber: params.TrackNumber,
+		Year:        params.Year,
+		Genre:       params.Genre,
+	}
+}
+
+// RecordPlayResponse is the body we send after recording a play.
+type RecordPlayResponse struct {
+	PlayId int64 `json:"play_id"`
+	// whether the play was a duplicate of one we already had. if so, PlayId
+	// is that play's ID.
+	Duplicate bool `json:"duplicate"`
+}
+
+// recentPlaysLimitMax is the maximum number of plays we respond with for a
+// 'recent plays' or 'plays by artist' request.
+const recentPlaysLimitMax = 200
+
+// playsByArtistLimitDefault is the number of plays we respond with for a
+// 'plays by artist' request if no limit is given.
+const playsByArtistLimitDefault = 50
+
+// healthCheckTimeout is how long we wait on the database during a health
+// check. it is short so that we cannot block a probe.
+const healthCheckTimeout = 2 * time.Second
+
+// defaultTopLimitMax is the maximum number of 'top' results we respond to
+// if the config does not say.
+const defaultTopLimitMax = 100
+
+// defaultMaxRequestBodyBytes is the largest request body we accept if the
+// config does not say.
+const defaultMaxRequestBodyBytes = 10 * 1024 * 1024
+
+// defaultQueryTimeoutSeconds is how long a request may run if the config
+// does not say.
+const defaultQueryTimeoutSeconds = 30
+
+// defaultSlowQueryThresholdMs is how long a query may take before we log
+// it as slow if the config does not say.
+const defaultSlowQueryThresholdMs = 500
+
+// defaultDuplicateWindowSeconds is the duplicate play window if the config
+// does not say.
+const defaultDuplicateWindowSeconds = 30
+
+// defaultShutdownTimeoutSeconds is how long we wait for in-flight requests
+// when shutting down if the config does not say.
+const defaultShutdownTimeoutSeconds = 30
+
+// serveModeFCGI and serveModeHTTP are the values ServeMode may have. we
+// serve FastCGI if the config does not say.
+const (
+	serveModeFCGI = "fcgi"
+	serveModeHTTP = "http"
+)
+
+// longRequestTimeout is how long we let requests that move a lot of data,
+// such as exports and imports, run.
+const longRequestTimeout = 5 * time.Minute
+
+// loadConfig reads our config file and fills in defaults for any settings
+// that are not set.
+func loadConfig(path string) (*Config, error) {
+	var settings Config
+	err := config.GetConfig(path, &settings)
+	if err != nil {
+		return nil, err
+	}
+	if settings.TopLimitMax == 0 {
+		settings.TopLimitMax = defaultTopLimitMax
+	}
+	if settings.MaxRequestBodyBytes == 0 {
+		settings.MaxRequestBodyBytes = defaultMaxRequestBodyBytes
+	}
+	if settings.QueryTimeoutSeconds == 0 {
+		settings.QueryTimeoutSeconds = defaultQueryTimeoutSeconds
+	}
+	if settings.SlowQueryThresholdMs == 0 {
+		settings.SlowQueryThresholdMs = defaultSlowQueryThresholdMs
+	}
+	if settings.DuplicateWindowSeconds == 0 {
+		settings.DuplicateWindowSeconds = defaultDuplicateWindowSeconds
+	}
+	if settings.ShutdownTimeoutSeconds == 0 {
+		settings.ShutdownTimeoutSeconds = defaultShutdownTimeoutSeconds
+	}
+	if len(settings.ServeMode) == 0 {
+		settings.ServeMode = serveModeFCGI
+	}
+	if settings.ServeMode != serveModeFCGI &&
+		settings.ServeMode != serveModeHTTP {
+		return nil, fmt.Errorf("Invalid ServeMode: %s", settings.ServeMode)
+	}
+	if (len(settings.TLSCertFile) > 0) != (len(settings.TLSKeyFile) > 0) {
+		return nil, errors.New("TLSCertFile and TLSKeyFile must be set together")
+	}
+	if settings.tlsEnabled() && settings.ServeMode != serveModeHTTP {
+		return nil, errors.New("TLSCertFile and TLSKeyFile require ServeMode http")
+	}
+	if len(settings.ListenSocket) > 0 {
+		if len(settings.ListenHost) > 0 || settings.ListenPort != 0 {
+			return nil, errors.New("ListenSocket may not be set along with ListenHost or ListenPort")
+		}
+	} else if settings.ListenPort == 0 {
+		return nil, errors.New("ListenPort or ListenSocket must be set")
+	}
+	return &settings, nil
+}
+
+// listenSocketMode is the permissions we give our unix socket. the web
+// server must be in our group to connect.
+const listenSocketMode = 0660
+
+// listen opens the socket we serve requests on. this is the unix socket
+// if we have one, and otherwise the TCP port.
+func listen(settings *Config) (net.Listener, error) {
+	if len(settings.ListenSocket) == 0 {
+		return net.Listen("tcp", fmt.Sprintf("%s:%d", settings.ListenHost,
+			settings.ListenPort))
+	}
+
+	// the socket can be left over if we did not shut down cleanly.
+	err := os.Remove(settings.ListenSocket)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to remove old socket: %s", err.Error())
+	}
+
+	listener, err := net.Listen("unix", settings.ListenSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(settings.ListenSocket, listenSocketMode)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Unable to set socket permissions: %s",
+			err.Error())
+	}
+	return listener, nil
+}
+
+// tlsEnabled decides whether we serve HTTPS.
+func (settings *Config) tlsEnabled() bool {
+	return len(settings.TLSCertFile) > 0 && len(settings.TLSKeyFile) > 0
+}
+
+// checkTLSFiles makes sure we can load our certificate and key, so that we
+// find out about a problem with them now rather than at the first
+// handshake.
+func checkTLSFiles(settings *Config) error {
+	if !settings.tlsEnabled() {
+		return nil
+	}
+	_, err := tls.LoadX509KeyPair(settings.TLSCertFile, settings.TLSKeyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load certificate [%s] and key [%s]: %s",
+			settings.TLSCertFile, settings.TLSKeyFile, err.Error())
+	}
+	return nil
+}
+
+// corsAllowedOrigins splits the CORSAllowedOrigins setting into its
+// origins.
+func (settings *Config) corsAllowedOrigins() []string {
+	return strings.Fields(settings.CORSAllowedOrigins)
+}
+
+// apiKeys splits the APIKeys setting into its keys.
+func (settings *Config) apiKeys() []string {
+	return strings.Fields(settings.APIKeys)
+}
 
-// TopLimitMax defines the maximum number of 'top' results we respond to.
-var TopLimitMax = 100
+// adminAPIKeys splits the AdminAPIKeys setting into its keys.
+func (settings *Config) adminAPIKeys() []string {
+	return strings.Fields(settings.AdminAPIKeys)
+}
 
 // connectToDb opens a new connection to the database.
 func connectToDb(settings *Config) (*sql.DB, error) {
@@ -83,112 +420,300 @@ func connectToDb(settings *Config) (*sql.DB, error) {
 		log.Print("Failed to connect to the database: " + err.Error())
 		return nil, err
 	}
-	log.Print("Opened new connection to the database.")
+	log.Print("Opened database connection pool.")
 	return db, nil
 }
 
-// getDb connects us to the database if necessary, and returns an active
-// database connection.
-// we use the global Db variable to try to ensure we use a single connection.
-func getDb(settings *Config) (*sql.DB, error) {
-	// if we have a db connection, ensure that it is still available
-	// so that we reconnect if it is not.
-	if Db != nil {
-		err := Db.Ping()
-		if err != nil {
-			log.Printf("Database ping failed: %s", err.Error())
-			// continue on, but set us so that we attempt to reconnect.
-			Db.Close()
-			Db = nil
-		}
+// configureDbPool applies our connection pool settings. we leave the
+// database/sql defaults in place for any that are unset.
+func configureDbPool(db *sql.DB, settings *Config) {
+	if settings.DbMaxOpenConns > 0 {
+		db.SetMaxOpenConns(int(settings.DbMaxOpenConns))
 	}
-	// connect to the database if necessary.
-	if Db == nil {
-		db, err := connectToDb(settings)
-		if err != nil {
-			log.Printf("Failed to connect to the database: %s", err.Error())
-			return nil, err
-		}
-		Db = db
+	if settings.DbMaxIdleConns > 0 {
+		db.SetMaxIdleConns(int(settings.DbMaxIdleConns))
+	}
+	if settings.DbConnMaxLifetimeSeconds > 0 {
+		db.SetConnMaxLifetime(
+			time.Duration(settings.DbConnMaxLifetimeSeconds) * time.Second)
+	}
+	if settings.DbConnMaxIdleTimeSeconds > 0 {
+		db.SetConnMaxIdleTime(
+			time.Duration(settings.DbConnMaxIdleTimeSeconds) * time.Second)
+	}
+}
+
+// ErrorResponse is the body we send when a request fails.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// sendJSONError sends a response with the given status code and a json
+// body holding the given message.
+func sendJSONError(rw http.ResponseWriter, status int, message string) {
+	b, err := json.Marshal(ErrorResponse{Error: message})
+	if err != nil {
+		log.Printf("Failed to encode error response: %s", err.Error())
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf8")
+	rw.WriteHeader(status)
+	rw.Write(b)
+}
+
+// sendJSONResponse encodes the given value as json and sends it with the
+// given status code.
+func sendJSONResponse(rw http.ResponseWriter, status int,
+	response interface{}) error {
+	b, err := json.Marshal(response)
+	if err != nil {
+		return err
 	}
-	return Db, nil
+	rw.Header().Set("Content-Type", "application/json; charset=utf8")
+	rw.WriteHeader(status)
+	rw.Write(b)
+	return nil
+}
+
+// send400Error sends a bad request error with the given message in the
+// body. we use this when the client sent us invalid parameters.
+func send400Error(rw http.ResponseWriter, message string) {
+	sendJSONError(rw, http.StatusBadRequest, message)
+}
+
+// send404Error sends a not found error with the given message in the body.
+func send404Error(rw http.ResponseWriter, message string) {
+	sendJSONError(rw, http.StatusNotFound, message)
 }
 
 // send500Error sends an internal server error with the given message in the
 // body.
 func send500Error(rw http.ResponseWriter, message string) {
-	rw.WriteHeader(http.StatusInternalServerError)
-	rw.Write([]byte(message))
+	sendJSONError(rw, http.StatusInternalServerError, message)
+}
+
+// TopParameters holds the parameters to a top artists/songs request.
+type TopParameters struct {
+	UserId int64
+	// limit of top count.
+	Limit int64
+	// how many results to skip. for paging.
+	Offset int64
+	// days back to build the top count for. if days back is -1, we find
+	// the count for all time.
+	DaysBack int64
+}
+
+// getIntParameter retrieves an integer parameter from the request form.
+// the form must already be parsed. we say whether the parameter was given.
+func getIntParameter(request *http.Request, name string) (int64, bool,
+	error) {
+	valueStr, exists := request.Form[name]
+	if !exists || len(valueStr) != 1 {
+		return 0, false, nil
+	}
+	value, err := strconv.ParseInt(valueStr[0], 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
+// getUserIdParameter retrieves the required user_id parameter.
+func getUserIdParameter(request *http.Request) (int64, error) {
+	userId, exists, err := getIntParameter(request, "user_id")
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, errors.New("No user ID given")
+	}
+	if userId < 0 {
+		return 0, errors.New("Invalid user ID")
+	}
+	return userId, nil
+}
+
+// getLimitParameter retrieves the required limit parameter. it must be
+// at least 1 and at most the given maximum.
+func getLimitParameter(request *http.Request, max int64) (int64, error) {
+	limit, exists, err := getIntParameter(request, "limit")
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, errors.New("No limit given")
+	}
+	if limit < 1 || limit > max {
+		return 0, errors.New("Invalid limit")
+	}
+	return limit, nil
+}
+
+// getOptionalLimitParameter retrieves the optional limit parameter. if it
+// is not given we use the given default. it must be at least 1 and at most
+// the given maximum.
+func getOptionalLimitParameter(request *http.Request, def int64,
+	max int64) (int64, error) {
+	_, exists, err := getIntParameter(request, "limit")
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return def, nil
+	}
+	return getLimitParameter(request, max)
+}
+
+// getStringParameter retrieves a required string parameter. it must not
+// be blank.
+func getStringParameter(request *http.Request, name string) (string,
+	error) {
+	value, exists := request.Form[name]
+	if !exists || len(value) != 1 || len(value[0]) == 0 {
+		return "", fmt.Errorf("No %s given", name)
+	}
+	return value[0], nil
+}
+
+// getOffsetParameter retrieves the optional offset parameter. it defaults
+// to 0.
+func getOffsetParameter(request *http.Request) (int64, error) {
+	offset, _, err := getIntParameter(request, "offset")
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, errors.New("Invalid offset")
+	}
+	return offset, nil
+}
+
+// getDaysBackParameter retrieves the optional days_back parameter. if it
+// is not given we return -1, meaning all time.
+func getDaysBackParameter(request *http.Request) (int64, error) {
+	daysBack, exists, err := getIntParameter(request, "days_back")
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return -1, nil
+	}
+	if daysBack < 1 {
+		return 0, errors.New("Invalid days back")
+	}
+	return daysBack, nil
+}
+
+// getOptionalIntParameter retrieves an optional integer parameter. it must
+// be within [min, max]. if it is not given we return def.
+func getOptionalIntParameter(request *http.Request, name string, def int64,
+	min int64, max int64) (int64, error) {
+	value, exists, err := getIntParameter(request, name)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return def, nil
+	}
+	if value < min || value > max {
+		return 0, fmt.Errorf("Invalid %s. It must be between %d and %d", name,
+			min, max)
+	}
+	return value, nil
+}
+
+// getDateParameter retrieves an optional date parameter in the form
+// YYYY-MM-DD. the date is taken to be in UTC.
+// we return the date and whether the parameter was given.
+func getDateParameter(request *http.Request, name string) (time.Time, bool,
+	error) {
+	value, exists := request.Form[name]
+	if !exists {
+		return time.Time{}, false, nil
+	}
+	if len(value) != 1 {
+		return time.Time{}, false, fmt.Errorf("Invalid %s", name)
+	}
+	date, err := time.Parse("2006-01-02", value[0])
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("Invalid %s: %s", name, err.Error())
+	}
+	return date, true, nil
 }
 
 // getParametersTopRequest retrieves and validates parameters to a
 // top artists/songs request.
-// we return: user_id, limit (limit of top count), days back to build
-//   the top artists count for. if days back is -1, we find the count
-//   for all time.
-func getParametersTopRequest(request *http.Request) (int64, int64, int64, error) {
+func getParametersTopRequest(request *http.Request,
+	settings *Config) (*TopParameters, error) {
+	logger := requestLogger(request)
+
 	// pull the parameters out and convert and validate them.
 	err := request.ParseForm()
 	if err != nil {
-		return 0, 0, 0, err
+		return nil, err
 	}
 
-	// user_id. required.
-	userIdStr, exists := request.Form["user_id"]
-	if !exists || len(userIdStr) != 1 {
-		return 0, 0, 0, errors.New("No user ID given")
-	}
-	userId, err := strconv.ParseInt(userIdStr[0], 10, 64)
+	userId, err := getUserIdParameter(request)
 	if err != nil {
-		return 0, 0, 0, err
-	}
-	if userId < 0 {
-		return 0, 0, 0, errors.New("Invalid user ID")
+		return nil, err
 	}
-
-	// limit. required.
-	limitStr, exists := request.Form["limit"]
-	if !exists || len(limitStr) != 1 {
-		return 0, 0, 0, errors.New("No limit given")
+	limit, err := getLimitParameter(request, int64(settings.TopLimitMax))
+	if err != nil {
+		return nil, err
 	}
-	limit, err := strconv.ParseInt(limitStr[0], 10, 64)
+	offset, err := getOffsetParameter(request)
 	if err != nil {
-		return 0, 0, 0, err
+		return nil, err
 	}
-	if limit < 1 || int(limit) > TopLimitMax {
-		return 0, 0, 0, errors.New("Invalid limit")
+	daysBack, err := getDaysBackParameter(request)
+	if err != nil {
+		return nil, err
 	}
+	logger.Printf("Parameters: user_id [%d] limit [%d] offset [%d] days_back [%d]",
+		userId, limit, offset, daysBack)
+	return &TopParameters{
+		UserId:   userId,
+		Limit:    limit,
+		Offset:   offset,
+		DaysBack: daysBack,
+	}, nil
+}
 
-	// days_back. optional.
-	daysBackStr, exists := request.Form["days_back"]
-	var daysBack int64 = -1
-	if exists && len(daysBackStr) == 1 {
-		daysBack, err = strconv.ParseInt(daysBackStr[0], 10, 64)
-		if err != nil {
-			return 0, 0, 0, err
-		}
-		if daysBack < 1 {
-			return 0, 0, 0, errors.New("Invalid days back")
-		}
+// daysBackInterval builds the interval to use in a query for the given
+// number of days back. if days back is -1, the interval covers all time.
+func daysBackInterval(daysBack int64) string {
+	interval := fmt.Sprintf("%d days", daysBack)
+	if daysBack == -1 {
+		// arbitrary. another alternative is to take out the create_time
+		// comparison, but that means having a separate query (or messing
+		// around with parameters more than I want)
+		interval = "1000 years"
 	}
-	log.Printf("Parameters: user_id [%d] limit [%d] days_back [%d]",
-		userId, limit, daysBack)
-	return userId, limit, daysBack, nil
+	log.Printf("Using interval [%s]", interval)
+	return interval
 }
 
 // retrieveTopArtists retrieves the top artist counts.
-// we find the top 'limit' artists for the given user.
+// we find the top 'limit' artists for the given user, skipping 'offset'
+// of them.
 // we do this for the specified number of days back. if the given
 // days back is set as -1, we find the top artists of all time.
-func retrieveTopArtists(settings *Config, userId int64, limit int64,
-	daysBack int64) ([]TopResult, error) {
-	// we need a database connection.
-	// TODO: we could try a cache first.
-	db, err := getDb(settings)
-	if err != nil {
-		return nil, err
+// we also return how many artists there are in total.
+// we use cached results if we have them.
+func retrieveTopArtists(ctx context.Context, db *sql.DB, cache *Cache,
+	params *TopParameters) ([]TopResult, int64, error) {
+	cacheKey := topCacheKey("artists", params)
+	results, total, ok := cache.get(cacheKey)
+	if ok {
+		return results, total, nil
 	}
 
+	defer observeQuery("top_artists", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", params.UserId,
+			params.Limit))
+
 	query := `
 SELECT
 COUNT(s.id) AS count,
@@ -203,46 +728,57 @@ AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
 GROUP BY s.artist
 ORDER BY count DESC
 LIMIT $3
+OFFSET $4
 `
-	interval := fmt.Sprintf("%d days", daysBack)
-	if daysBack == -1 {
-		// arbitrary. another alternative is to take out the create_time
-		// comparison, but that means having a separate query (or messing
-		// around with parameters more than I want)
-		interval = "1000 years"
-	}
-	log.Printf("Using interval [%s]", interval)
+	interval := daysBackInterval(params.DaysBack)
 
-	rows, err := db.Query(query, userId, interval, limit)
+	results, err := queryTopResults(ctx, db, query, params.UserId, interval,
+		params.Limit, params.Offset)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	var results []TopResult
-	for rows.Next() {
-		var result TopResult
-		err := rows.Scan(&result.Count, &result.Label)
-		if err != nil {
-			return nil, err
-		}
-		results = append(results, result)
+	totalQuery := `
+SELECT COUNT(DISTINCT s.artist)
+FROM play p
+LEFT JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.artist != 'N/A'
+AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+`
+	err = db.QueryRowContext(ctx, totalQuery, params.UserId,
+		interval).Scan(&total)
+	if err != nil {
+		return nil, 0, err
 	}
-	return results, nil
+
+	cache.set(cacheKey, params.UserId, results, total)
+	return results, total, nil
 }
 
 // retrieveTopSongs retrieves the top song counts.
-// we find the top 'limit' artists for the given user.
+// we find the top 'limit' songs for the given user, skipping 'offset'
+// of them.
+// songs are labelled with their artist as well as their title so that
+// same-titled songs by different artists are counted separately.
 // we do this for the specified number of days back. if the given
 // days back is set as -1, we find the top songs of all time.
-func retrieveTopSongs(settings *Config, userId int64, limit int64,
-	daysBack int64) ([]TopResult, error) {
-	// we need a database connection.
-	// TODO: we could try a cache first.
-	db, err := getDb(settings)
-	if err != nil {
-		return nil, err
+// we also return how many songs there are in total.
+// we use cached results if we have them.
+func retrieveTopSongs(ctx context.Context, db *sql.DB, cache *Cache,
+	params *TopParameters) ([]TopResult, int64, error) {
+	cacheKey := topCacheKey("songs", params)
+	results, total, ok := cache.get(cacheKey)
+	if ok {
+		return results, total, nil
 	}
 
+	defer observeQuery("top_songs", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", params.UserId,
+			params.Limit))
+
 	query := `
 SELECT
 COUNT(1) AS count,
@@ -256,105 +792,1103 @@ AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
 GROUP BY label
 ORDER BY count DESC
 LIMIT $3
+OFFSET $4
 `
-	interval := fmt.Sprintf("%d days", daysBack)
-	if daysBack == -1 {
-		// arbitrary. another alternative is to take out the create_time
-		// comparison, but that means having a separate query (or messing
-		// around with parameters more than I want)
-		interval = "1000 years"
-	}
-	log.Printf("Using interval [%s]", interval)
+	interval := daysBackInterval(params.DaysBack)
 
-	rows, err := db.Query(query, userId, interval, limit)
+	results, err := queryTopResults(ctx, db, query, params.UserId, interval,
+		params.Limit, params.Offset)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	var results []TopResult
-	for rows.Next() {
-		var result TopResult
-		err := rows.Scan(&result.Count, &result.Label)
-		if err != nil {
-			return nil, err
-		}
-		results = append(results, result)
+	totalQuery := `
+SELECT COUNT(DISTINCT CONCAT(s.artist, ' - ', s.title))
+FROM play p
+LEFT JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+`
+	err = db.QueryRowContext(ctx, totalQuery, params.UserId,
+		interval).Scan(&total)
+	if err != nil {
+		return nil, 0, err
 	}
-	return results, nil
+
+	cache.set(cacheKey, params.UserId, results, total)
+	return results, total, nil
 }
 
-// responseTopCount sends the response to a top artists or songs request.
-func responseTopCount(rw http.ResponseWriter, counts []TopResult) error {
-	type TopResponse struct {
-		Counts []TopResult
-	}
-	topResponse := TopResponse{Counts: counts}
-	b, err := json.Marshal(topResponse)
-	if err != nil {
-		return err
+// retrieveTopAlbums retrieves the top album counts.
+// we find the top 'limit' albums for the given user, skipping 'offset'
+// of them.
+// albums are labelled with their artist as well as their name so that
+// same-named albums by different artists are counted separately.
+// we do this for the specified number of days back. if the given
+// days back is set as -1, we find the top albums of all time.
+// we also return how many albums there are in total.
+// we use cached results if we have them.
+func retrieveTopAlbums(ctx context.Context, db *sql.DB, cache *Cache,
+	params *TopParameters) ([]TopResult, int64, error) {
+	cacheKey := topCacheKey("albums", params)
+	results, total, ok := cache.get(cacheKey)
+	if ok {
+		return results, total, nil
 	}
-	rw.Header().Set("Content-Type", "application/json; charset=utf8")
-	rw.Write(b)
-	return nil
-}
 
-// handlerTopArtists looks up the top artists for a user.
-func handlerTopArtists(rw http.ResponseWriter, request *http.Request,
-	settings *Config) {
-	// find our parameters.
-	userId, limit, daysBack, err := getParametersTopRequest(request)
+	defer observeQuery("top_albums", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", params.UserId,
+			params.Limit))
+
+	query := `
+SELECT
+COUNT(p.id) AS count,
+CONCAT(s.artist, ' – ', s.album) AS label
+FROM play p
+LEFT JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+GROUP BY s.artist, s.album
+ORDER BY count DESC
+LIMIT $3
+OFFSET $4
+`
+	interval := daysBackInterval(params.DaysBack)
+
+	results, err := queryTopResults(ctx, db, query, params.UserId, interval,
+		params.Limit, params.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	totalQuery := `
+SELECT COUNT(*)
+FROM (
+	SELECT 1
+	FROM play p
+	LEFT JOIN song s
+	ON p.song_id = s.id
+	WHERE
+	p.user_id = $1
+	AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+	GROUP BY s.artist, s.album
+) albums
+`
+	err = db.QueryRowContext(ctx, totalQuery, params.UserId,
+		interval).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cache.set(cacheKey, params.UserId, results, total)
+	return results, total, nil
+}
+
+// retrieveTopGenres retrieves the top genre counts.
+// we find the top 'limit' genres for the given user, skipping 'offset'
+// of them. we leave out songs whose genre we do not know.
+// we do this for the specified number of days back. if the given
+// days back is set as -1, we find the top genres of all time.
+// we also return how many genres there are in total.
+// we use cached results if we have them.
+func retrieveTopGenres(ctx context.Context, db *sql.DB, cache *Cache,
+	params *TopParameters) ([]TopResult, int64, error) {
+	cacheKey := topCacheKey("genres", params)
+	results, total, ok := cache.get(cacheKey)
+	if ok {
+		return results, total, nil
+	}
+
+	defer observeQuery("top_genres", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", params.UserId,
+			params.Limit))
+
+	query := `
+SELECT
+COUNT(p.id) AS count,
+s.genre AS label
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.genre != ''
+AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+GROUP BY s.genre
+ORDER BY count DESC
+LIMIT $3
+OFFSET $4
+`
+	interval := daysBackInterval(params.DaysBack)
+
+	results, err := queryTopResults(ctx, db, query, params.UserId, interval,
+		params.Limit, params.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	totalQuery := `
+SELECT COUNT(DISTINCT s.genre)
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.genre != ''
+AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+`
+	err = db.QueryRowContext(ctx, totalQuery, params.UserId,
+		interval).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cache.set(cacheKey, params.UserId, results, total)
+	return results, total, nil
+}
+
+// queryTopResults runs a query selecting a count and a label, and
+// collects the rows.
+func queryTopResults(ctx context.Context, db *sql.DB, query string,
+	args ...interface{}) ([]TopResult, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []TopResult
+	for rows.Next() {
+		var result TopResult
+		err := rows.Scan(&result.Count, &result.Label)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// responseTopCount sends the response to a top artists or songs request.
+// total is how many results there are altogether, so that clients can
+// page through them.
+func responseTopCount(rw http.ResponseWriter, counts []TopResult,
+	total int64) error {
+	type TopResponse struct {
+		Counts []TopResult
+		Total  int64 `json:"total"`
+	}
+	topResponse := TopResponse{Counts: counts, Total: total}
+	b, err := json.Marshal(topResponse)
+	if err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf8")
+	rw.Write(b)
+	return nil
+}
+
+// responseTopCountCacheable sends the response to a top request, as
+// responseTopCount does. all time results only change when the user
+// records a play, so we let clients cache those.
+func responseTopCountCacheable(rw http.ResponseWriter, request *http.Request,
+	params *TopParameters, counts []TopResult, total int64) error {
+	if params.DaysBack != -1 {
+		return responseTopCount(rw, counts, total)
+	}
+	return cacheableResponse(rw, request, func(rw http.ResponseWriter) error {
+		return responseTopCount(rw, counts, total)
+	})
+}
+
+// handlerTopArtists looks up the top artists for a user.
+func handlerTopArtists(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersTopRequest(request, handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	// find the counts.
+	counts, total, err := retrieveTopArtists(request.Context(), handler.db,
+		handler.cache, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top artists: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = responseTopCountCacheable(rw, request, params, counts, total)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// handlerTopSongs looks up the top songs for a user.
+func handlerTopSongs(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersTopRequest(request, handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	// find the counts.
+	counts, total, err := retrieveTopSongs(request.Context(), handler.db,
+		handler.cache, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top songs: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = responseTopCountCacheable(rw, request, params, counts, total)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// handlerTopAlbums looks up the top albums for a user.
+func handlerTopAlbums(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersTopRequest(request, handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	// find the counts.
+	counts, total, err := retrieveTopAlbums(request.Context(), handler.db,
+		handler.cache, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top albums: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = responseTopCount(rw, counts, total)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// handlerTopGenres looks up the top genres for a user.
+func handlerTopGenres(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersTopRequest(request, handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	// find the counts.
+	counts, total, err := retrieveTopGenres(request.Context(), handler.db,
+		handler.cache, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top genres: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = responseTopCount(rw, counts, total)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// getParametersRecentPlays retrieves and validates parameters to a recent
+// plays request.
+// we return: user_id, limit, offset.
+func getParametersRecentPlays(request *http.Request) (int64, int64, int64,
+	error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	limit, err := getLimitParameter(request, recentPlaysLimitMax)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	offset, err := getOffsetParameter(request)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	logger.Printf("Parameters: user_id [%d] limit [%d] offset [%d]", userId,
+		limit, offset)
+	return userId, limit, offset, nil
+}
+
+// retrieveRecentPlays retrieves the most recent plays for the given user,
+// newest first.
+func retrieveRecentPlays(ctx context.Context, db *sql.DB, userId int64,
+	limit int64, offset int64) ([]RecentPlay, error) {
+	defer observeQuery("recent_plays", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", userId, limit))
+
+	query := `
+SELECT
+p.id,
+s.artist,
+s.album,
+s.title,
+s.length_ms,
+s.year,
+p.create_time
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+ORDER BY p.create_time DESC
+LIMIT $2
+OFFSET $3
+`
+	rows, err := db.QueryContext(ctx, query, userId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRecentPlays(rows)
+}
+
+// scanRecentPlays collects rows of plays. each row must have the play ID,
+// artist, album, title, length, year, and time of the play.
+func scanRecentPlays(rows *sql.Rows) ([]RecentPlay, error) {
+	plays := []RecentPlay{}
+	for rows.Next() {
+		var play RecentPlay
+		var createTime time.Time
+		err := rows.Scan(&play.PlayId, &play.Artist, &play.Album, &play.Title,
+			&play.LengthMs, &play.Year, &createTime)
+		if err != nil {
+			return nil, err
+		}
+		play.CreateTime = createTime.Format(time.RFC3339)
+		plays = append(plays, play)
+	}
+	return plays, rows.Err()
+}
+
+// handlerRecentPlays looks up the most recent plays for a user.
+func handlerRecentPlays(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, limit, offset, err := getParametersRecentPlays(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	plays, err := retrieveRecentPlays(request.Context(), handler.db, userId,
+		limit, offset)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve recent plays: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	type RecentPlaysResponse struct {
+		Plays []RecentPlay `json:"plays"`
+	}
+	err = sendJSONResponse(rw, http.StatusOK, RecentPlaysResponse{Plays: plays})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// PlaysByArtistParameters holds the parameters to a plays by artist
+// request.
+type PlaysByArtistParameters struct {
+	UserId int64
+	Artist string
+	Limit  int64
+	Offset int64
+}
+
+// getParametersPlaysByArtist retrieves and validates parameters to a plays
+// by artist request.
+func getParametersPlaysByArtist(
+	request *http.Request) (*PlaysByArtistParameters, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	artist, err := getStringParameter(request, "artist")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := getOptionalLimitParameter(request, playsByArtistLimitDefault,
+		recentPlaysLimitMax)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := getOffsetParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Parameters: user_id [%d] artist [%s] limit [%d] offset [%d]",
+		userId, artist, limit, offset)
+	return &PlaysByArtistParameters{
+		UserId: userId,
+		Artist: artist,
+		Limit:  limit,
+		Offset: offset,
+	}, nil
+}
+
+// retrievePlaysByArtist retrieves the given user's plays of songs by the
+// given artist, newest first. the artist must match exactly.
+func retrievePlaysByArtist(ctx context.Context, db *sql.DB, userId int64,
+	artist string, limit int64, offset int64) ([]RecentPlay, error) {
+	defer observeQuery("plays_by_artist", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", userId, limit))
+
+	query := `
+SELECT
+p.id,
+s.artist,
+s.album,
+s.title,
+s.length_ms,
+s.year,
+p.create_time
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.artist = $2
+ORDER BY p.create_time DESC
+LIMIT $3
+OFFSET $4
+`
+	rows, err := db.QueryContext(ctx, query, userId, artist, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRecentPlays(rows)
+}
+
+// handlerPlaysByArtist looks up a user's plays of an artist.
+func handlerPlaysByArtist(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersPlaysByArtist(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	plays, err := retrievePlaysByArtist(request.Context(), handler.db,
+		params.UserId, params.Artist, params.Limit, params.Offset)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve plays: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	type PlaysByArtistResponse struct {
+		Plays []RecentPlay `json:"plays"`
+	}
+	err = sendJSONResponse(rw, http.StatusOK,
+		PlaysByArtistResponse{Plays: plays})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// getParametersUserDaysBack retrieves and validates parameters to a
+// request taking only a user and how many days back to look, such as a
+// total plays request.
+// we return: user_id, days back. if days back is -1, we look at all time.
+func getParametersUserDaysBack(request *http.Request) (int64, int64,
+	error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	daysBack, err := getDaysBackParameter(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	logger.Printf("Parameters: user_id [%d] days_back [%d]", userId, daysBack)
+	return userId, daysBack, nil
+}
+
+// getParametersUserId retrieves and validates parameters to a request
+// taking only a user.
+func getParametersUserId(request *http.Request) (int64, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, err
+	}
+	logger.Printf("Parameters: user_id [%d]", userId)
+	return userId, nil
+}
+
+// retrieveTotalPlays counts the plays by the given user over the given
+// number of days back. if days back is -1, we count plays for all time.
+func retrieveTotalPlays(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64) (int64, error) {
+	defer observeQuery("total_plays", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	query := `
+SELECT COUNT(*)
+FROM play
+WHERE
+user_id = $1
+AND create_time > current_timestamp - CAST($2 AS INTERVAL)
+`
+	var total int64
+	err := db.QueryRowContext(ctx, query, userId,
+		daysBackInterval(daysBack)).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// handlerTotalPlays counts the plays for a user.
+func handlerTotalPlays(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, daysBack, err := getParametersUserDaysBack(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	total, err := retrieveTotalPlays(request.Context(), handler.db, userId,
+		daysBack)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve total plays: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK,
+		TotalPlaysResponse{UserId: userId, TotalPlays: total})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// DeletePlayResponse is the body we send in response to a delete play
+// request.
+type DeletePlayResponse struct {
+	Deleted bool `json:"deleted"`
+}
+
+// getParametersDeletePlay retrieves and validates parameters to a delete
+// play request.
+// we return: play ID, user_id.
+func getParametersDeletePlay(request *http.Request) (int64, int64, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	playId, err := strconv.ParseInt(getPathParameter(request, "play_id"), 10,
+		64)
+	if err != nil || playId < 1 {
+		return 0, 0, errors.New("Invalid play ID")
+	}
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	logger.Printf("Parameters: play_id [%d] user_id [%d]", playId, userId)
+	return playId, userId, nil
+}
+
+// retrievePlayOwner finds the user who made the given play. we return
+// whether the play exists.
+func retrievePlayOwner(ctx context.Context, db *sql.DB, playId int64) (int64,
+	bool, error) {
+	defer observeQuery("play_owner", time.Now(),
+		fmt.Sprintf("play_id [%d]", playId))
+
+	var userId int64
+	err := db.QueryRowContext(ctx, `SELECT user_id FROM play WHERE id = $1`,
+		playId).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return userId, true, nil
+}
+
+// deletePlay deletes the given user's play. we return whether we deleted
+// it.
+func deletePlay(ctx context.Context, db *sql.DB, playId int64,
+	userId int64) (bool, error) {
+	defer observeQuery("delete_play", time.Now(),
+		fmt.Sprintf("play_id [%d] user_id [%d]", playId, userId))
+
+	result, err := db.ExecContext(ctx,
+		`DELETE FROM play WHERE id = $1 AND user_id = $2`, playId, userId)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// handlerDeletePlay deletes a play, such as one recorded by mistake.
+func handlerDeletePlay(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	playId, userId, err := getParametersDeletePlay(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	// users may only delete their own plays. we respond the same way whether
+	// the play does not exist or is someone else's, so as not to reveal
+	// other users' plays.
+	ownerId, exists, err := retrievePlayOwner(request.Context(), handler.db,
+		playId)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve play: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+	if !exists || ownerId != userId {
+		logger.Printf("Play not found for user: play_id [%d] user_id [%d]",
+			playId, userId)
+		send404Error(rw, "No such play")
+		return
+	}
+
+	deleted, err := deletePlay(request.Context(), handler.db, playId, userId)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to delete play: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+	if !deleted {
+		// it went away since we looked.
+		send404Error(rw, "No such play")
+		return
+	}
+	logger.Printf("Deleted play [%d]", playId)
+	handler.cache.invalidateUser(userId)
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, DeletePlayResponse{Deleted: true})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// handlerHealth reports whether we are able to serve requests. we are
+// healthy if we can reach the database.
+func handlerHealth(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	status := http.StatusOK
+	response := HealthResponse{Status: "ok", Db: "up"}
+
+	err := pingDb(request.Context(), handler.db)
+	if err != nil {
+		logger.Printf("Health check failed: %s", err.Error())
+		status = http.StatusServiceUnavailable
+		response = HealthResponse{
+			Status: "degraded",
+			Db:     "down",
+			Error:  err.Error(),
+		}
+	}
+
+	err = sendJSONResponse(rw, status, response)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// pingDb checks that we can reach the database, giving up after
+// healthCheckTimeout.
+func pingDb(ctx context.Context, db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+// getParametersRecordPlay decodes and validates the body of a request to
+// record a play.
+func getParametersRecordPlay(request *http.Request) (*RecordPlayRequest,
+	error) {
+	logger := requestLogger(request)
+
+	var params RecordPlayRequest
+	err := json.NewDecoder(request.Body).Decode(&params)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid request body: %s", err.Error())
+	}
+
+	if params.UserId < 1 {
+		return nil, errors.New("Invalid user ID")
+	}
+	err = validatePlay(params.song())
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Parameters: user_id [%d] artist [%s] album [%s] title [%s] length_ms [%d] disc_number [%d] track_number [%d] year [%d] genre [%s]",
+		params.UserId, params.Artist, params.Album, params.Title, params.LengthMs,
+		params.DiscNumber, params.TrackNumber, params.Year, params.Genre)
+	return &params, nil
+}
+
+// validatePlay checks the details of the song of a play to record.
+func validatePlay(song *SongDetails) error {
+	if len(song.Artist) == 0 {
+		return errors.New("No artist given")
+	}
+	if len(song.Album) == 0 {
+		return errors.New("No album given")
+	}
+	if len(song.Title) == 0 {
+		return errors.New("No title given")
+	}
+	if song.LengthMs < 1 {
+		return errors.New("Invalid length")
+	}
+	if song.DiscNumber < 0 {
+		return errors.New("Invalid disc number")
+	}
+	if song.TrackNumber < 0 {
+		return errors.New("Invalid track number")
+	}
+	if song.Year < 0 || song.Year > songYearMax {
+		return errors.New("Invalid year")
+	}
+	return nil
+}
+
+// retrieveOrCreateSong finds the ID of the song with the given details,
+// adding the song if we do not know it yet.
+//
+// the disc and track number are part of what identifies a song, since an
+// album can have the same title more than once. if we do not know either
+// for the song we have or for the one given, that part matches anything,
+// though we prefer an exact match. if we did not know the disc number,
+// track number, year, or genre before, we fill them in.
+func retrieveOrCreateSong(ctx context.Context, tx *sql.Tx,
+	song *SongDetails) (int64, error) {
+	query := `
+SELECT id, disc_number, track_number, year, genre FROM song
+WHERE
+artist = $1
+AND album = $2
+AND title = $3
+AND length_ms = $4
+AND ($5 = 0 OR disc_number IN ($5, 0))
+AND ($6 = 0 OR track_number IN ($6, 0))
+ORDER BY disc_number = $5 DESC, track_number = $6 DESC, id
+LIMIT 1
+`
+	var songId int64
+	var discNumber, trackNumber, year int64
+	var genre string
+	err := tx.QueryRowContext(ctx, query, song.Artist, song.Album,
+		song.Title, song.LengthMs, song.DiscNumber, song.TrackNumber).Scan(
+		&songId, &discNumber, &trackNumber, &year, &genre)
+	if err == nil {
+		if (discNumber == 0 && song.DiscNumber > 0) ||
+			(trackNumber == 0 && song.TrackNumber > 0) ||
+			(year == 0 && song.Year > 0) ||
+			(genre == "" && song.Genre != "") {
+			query = `
+UPDATE song SET
+disc_number = CASE WHEN disc_number = 0 THEN $1 ELSE disc_number END,
+track_number = CASE WHEN track_number = 0 THEN $2 ELSE track_number END,
+year = CASE WHEN year = 0 THEN $3 ELSE year END,
+genre = CASE WHEN genre = '' THEN $4 ELSE genre END
+WHERE id = $5
+`
+			_, err = tx.ExecContext(ctx, query, song.DiscNumber,
+				song.TrackNumber, song.Year, song.Genre, songId)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return songId, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	query = `
+INSERT INTO song
+(artist, album, title, length_ms, disc_number, track_number, year, genre)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING id
+`
+	err = tx.QueryRowContext(ctx, query, song.Artist, song.Album, song.Title,
+		song.LengthMs, song.DiscNumber, song.TrackNumber, song.Year,
+		song.Genre).Scan(&songId)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Added song [%d]", songId)
+	return songId, nil
+}
+
+// retrieveDuplicatePlay finds the user's most recent play of the song
+// within the duplicate window. we say whether there is one.
+//
+// we first take a lock on the user and song that lasts until the
+// transaction ends. otherwise two retries of the same play at once could
+// both find no duplicate and both record it.
+func retrieveDuplicatePlay(ctx context.Context, tx *sql.Tx, userId int64,
+	songId int64, duplicateWindow time.Duration) (int64, bool, error) {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, $2)",
+		userId, songId)
+	if err != nil {
+		return 0, false, err
+	}
+
+	query := `
+SELECT id FROM play
+WHERE
+user_id = $1
+AND song_id = $2
+AND create_time > current_timestamp - $3 * INTERVAL '1 second'
+ORDER BY create_time DESC
+LIMIT 1
+`
+	var playId int64
+	err = tx.QueryRowContext(ctx, query, userId, songId,
+		int64(duplicateWindow.Seconds())).Scan(&playId)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
 	if err != nil {
-		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
-		log.Printf(msg)
-		send500Error(rw, msg)
-		return
+		return 0, false, err
 	}
+	return playId, true, nil
+}
 
-	// find the counts.
-	counts, err := retrieveTopArtists(settings, userId, limit, daysBack)
+// recordPlay records a play of a song by a user. we add the song if
+// necessary. we return the ID of the new play.
+//
+// if the user played the same song within the duplicate window, we take
+// this to be the same play sent twice (such as by a client retrying) and
+// do not record it. in that case we return the existing play's ID and
+// true.
+func recordPlay(ctx context.Context, db *sql.DB, params *RecordPlayRequest,
+	duplicateWindow time.Duration) (int64, bool, error) {
+	defer observeQuery("record_play", time.Now(),
+		fmt.Sprintf("user_id [%d]", params.UserId))
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to retrieve top artists: %s", err.Error())
-		log.Printf(msg)
-		send500Error(rw, msg)
-		return
+		return 0, false, err
 	}
 
-	// build and send the response.
-	err = responseTopCount(rw, counts)
+	songId, err := retrieveOrCreateSong(ctx, tx, params.song())
 	if err != nil {
-		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
-		log.Printf(msg)
-		send500Error(rw, msg)
-		return
+		tx.Rollback()
+		return 0, false, err
+	}
+
+	existingId, duplicate, err := retrieveDuplicatePlay(ctx, tx,
+		params.UserId, songId, duplicateWindow)
+	if err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+	if duplicate {
+		err = tx.Commit()
+		if err != nil {
+			return 0, false, err
+		}
+		return existingId, true, nil
+	}
+
+	query := `
+INSERT INTO play
+(user_id, song_id, create_time)
+VALUES($1, $2, current_timestamp)
+RETURNING id
+`
+	var playId int64
+	err = tx.QueryRowContext(ctx, query, params.UserId, songId).Scan(&playId)
+	if err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, err
 	}
+	return playId, false, nil
 }
 
-// handlerTopSongs looks up the top songs for a user.
-func handlerTopSongs(rw http.ResponseWriter, request *http.Request,
-	settings *Config) {
+// handlerRecordPlay records a play of a song.
+func handlerRecordPlay(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
 	// find our parameters.
-	userId, limit, daysBack, err := getParametersTopRequest(request)
+	params, err := getParametersRecordPlay(request)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
-		log.Printf(msg)
-		send500Error(rw, msg)
+		logger.Printf(msg)
+		send400Error(rw, msg)
 		return
 	}
 
-	// find the counts.
-	counts, err := retrieveTopSongs(settings, userId, limit, daysBack)
+	duplicateWindow := time.Duration(handler.settings.DuplicateWindowSeconds) *
+		time.Second
+	playId, duplicate, err := recordPlay(request.Context(), handler.db, params,
+		duplicateWindow)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to retrieve top artists: %s", err.Error())
-		log.Printf(msg)
+		msg := fmt.Sprintf("Failed to record play: %s", err.Error())
+		logger.Printf(msg)
 		send500Error(rw, msg)
 		return
 	}
 
+	status := http.StatusCreated
+	if duplicate {
+		logger.Printf("Play is a duplicate of play [%d]", playId)
+		status = http.StatusOK
+	} else {
+		logger.Printf("Recorded play [%d]", playId)
+		handler.cache.invalidateUser(params.UserId)
+	}
+
 	// build and send the response.
-	err = responseTopCount(rw, counts)
+	err = sendJSONResponse(rw, status,
+		RecordPlayResponse{PlayId: playId, Duplicate: duplicate})
 	if err != nil {
 		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
-		log.Printf(msg)
+		logger.Printf(msg)
 		send500Error(rw, msg)
 		return
 	}
@@ -362,46 +1896,356 @@ func handlerTopSongs(rw http.ResponseWriter, request *http.Request,
 
 // ServeHTTP is a function to implement the http.Handler interface.
 // we service http requests.
-func (handler HttpHandler) ServeHTTP(rw http.ResponseWriter,
+func (server *Server) ServeHTTP(rw http.ResponseWriter,
 	request *http.Request) {
-	log.Printf("Serving new [%s] request from [%s] to path [%s]",
+	// connections open before we closed the listener can still send us
+	// requests while we shut down.
+	if !server.startRequest() {
+		log.Printf("Refusing request while shutting down: method [%s] remote_addr [%s] path [%s]",
+			request.Method, request.RemoteAddr, request.URL.Path)
+		rw.Header().Set("Connection", "close")
+		sendJSONError(rw, http.StatusServiceUnavailable,
+			"503 Service Unavailable: Shutting down")
+		return
+	}
+	defer server.inFlight.Done()
+
+	log.Printf("Serving new request: method [%s] remote_addr [%s] path [%s]",
 		request.Method, request.RemoteAddr, request.URL.Path)
 
-	// define our handlers.
-	var handlers = []RequestHandler{
+	// the request uses the state as it is now throughout, even if we reload
+	// while serving it.
+	state := server.state.Load()
+	handler := &HttpHandler{
+		settings: state.settings,
+		db:       state.db,
+		handlers: state.handlers,
+		cache:    server.cache,
+	}
+
+	corsMiddleware(dispatchRequest)(rw, request, handler)
+}
+
+// startRequest counts a request as in flight. we say whether we may serve
+// it, which we may not once we are shutting down.
+func (server *Server) startRequest() bool {
+	server.shutdownMutex.RLock()
+	defer server.shutdownMutex.RUnlock()
+	if server.shuttingDown {
+		return false
+	}
+	server.inFlight.Add(1)
+	return true
+}
+
+// dispatchRequest finds the handler for the request and runs it.
+func dispatchRequest(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	// find a matching handler.
+	for _, actionHandler := range handler.handlers {
+		if actionHandler.Method != request.Method {
+			continue
+		}
+		matches := actionHandler.compiledPattern.FindStringSubmatch(
+			request.URL.Path)
+		if matches != nil {
+			// make named groups in the pattern available to the handler.
+			request = withPathParameters(request, actionHandler.compiledPattern,
+				matches)
+
+			timeout := actionHandler.Timeout
+			if timeout == 0 {
+				timeout = time.Duration(handler.settings.QueryTimeoutSeconds) *
+					time.Second
+			}
+			fn := timeoutMiddleware(timeout)(actionHandler.Func)
+			fn = gzipMiddleware(fn)
+			fn = maxBytesMiddleware(int64(handler.settings.MaxRequestBodyBytes))(fn)
+			if actionHandler.Admin {
+				fn = adminAuthMiddleware(fn)
+			} else if !actionHandler.Public {
+				fn = authMiddleware(fn)
+			}
+			if !actionHandler.SkipMetrics {
+				fn = metricsMiddleware(
+					routePath(actionHandler.PathPattern, handler.settings.UriPrefix), fn)
+			}
+			requestIDMiddleware(fn)(rw, request, handler)
+			return
+		}
+	}
+
+	// if we serve the path but not with this method, say which methods we
+	// do serve it with.
+	methods := handler.pathMethods(request.URL.Path)
+	if len(methods) > 0 {
+		log.Printf("Method not allowed for this path.")
+		rw.Header().Set("Allow", strings.Join(methods, ", "))
+		sendJSONError(rw, http.StatusMethodNotAllowed, "405 Method Not Allowed")
+		return
+	}
+
+	// there was no matching handler - send a 404.
+	log.Printf("No handler for this request.")
+	sendJSONError(rw, http.StatusNotFound, "404 Not Found")
+}
+
+// pathMethods finds the methods we have handlers for on the given path.
+func (handler *HttpHandler) pathMethods(path string) []string {
+	var methods []string
+	for _, actionHandler := range handler.handlers {
+		if actionHandler.compiledPattern.MatchString(path) {
+			methods = append(methods, actionHandler.Method)
+		}
+	}
+	return methods
+}
+
+// routePath turns a handler's path pattern back into a plain path, for
+// example for use as a label.
+func routePath(pattern string, uriPrefix string) string {
+	path := strings.TrimPrefix(pattern, "^"+uriPrefix)
+	return strings.TrimSuffix(path, "$")
+}
+
+// getHandlers defines the requests we service.
+func getHandlers(settings *Config) []RequestHandler {
+	handlers := []RequestHandler{
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/health$",
+			Func:        handlerHealth,
+			Public:      true,
+		},
 		RequestHandler{
 			Method:      "GET",
-			PathPattern: "^" + handler.settings.UriPrefix + "/top/artists",
+			PathPattern: "^" + settings.UriPrefix + "/metrics$",
+			Func:        handlerMetrics,
+			SkipMetrics: true,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/top/artists$",
 			Func:        handlerTopArtists,
 		},
 		RequestHandler{
 			Method:      "GET",
-			PathPattern: "^" + handler.settings.UriPrefix + "/top/songs",
+			PathPattern: "^" + settings.UriPrefix + "/top/songs$",
 			Func:        handlerTopSongs,
 		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/top/albums$",
+			Func:        handlerTopAlbums,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/top/genres$",
+			Func:        handlerTopGenres,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/top/trending$",
+			Func:        handlerTrending,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/top/global/artists$",
+			Func:        handlerGlobalTopArtists,
+			Admin:       true,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/top/global/songs$",
+			Func:        handlerGlobalTopSongs,
+			Admin:       true,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/plays/recent$",
+			Func:        handlerRecentPlays,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/plays/by-artist$",
+			Func:        handlerPlaysByArtist,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/feed/recent$",
+			Func:        handlerFeedRecent,
+		},
+		RequestHandler{
+			Method:      "DELETE",
+			PathPattern: "^" + settings.UriPrefix + "/plays/(?P<play_id>[0-9]+)$",
+			Func:        handlerDeletePlay,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/plays/total$",
+			Func:        handlerTotalPlays,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/heatmap$",
+			Func:        handlerHeatmap,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/plays-by-hour$",
+			Func:        handlerPlaysByHour,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/plays-by-dow$",
+			Func:        handlerPlaysByDOW,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/plays-by-decade$",
+			Func:        handlerPlaysByDecade,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/year-review$",
+			Func:        handlerYearReview,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/streak$",
+			Func:        handlerStreak,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/diversity$",
+			Func:        handlerDiversity,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/milestones$",
+			Func:        handlerMilestones,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/new-artists$",
+			Func:        handlerNewArtists,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/avg-length$",
+			Func:        handlerAvgLength,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/compare$",
+			Func:        handlerCompare,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/daily-plays$",
+			Func:        handlerDailyPlays,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/rolling-average$",
+			Func:        handlerRollingAverage,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/discography-coverage$",
+			Func:        handlerDiscographyCoverage,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/session-groups$",
+			Func:        handlerSessionGroups,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/stats/top-sessions$",
+			Func:        handlerTopSessions,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/songs/history$",
+			Func:        handlerSongHistory,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/artists$",
+			Func:        handlerArtists,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/artists/albums$",
+			Func:        handlerAlbumsForArtist,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/search/songs$",
+			Func:        handlerSearchSongs,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/users$",
+			Func:        handlerListUsers,
+			Admin:       true,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/db/ping$",
+			Func:        handlerDbPing,
+			Admin:       true,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/export/plays$",
+			Func:        handlerExportPlays,
+			Timeout:     longRequestTimeout,
+		},
+		RequestHandler{
+			Method:      "GET",
+			PathPattern: "^" + settings.UriPrefix + "/recommendations/artist-explore$",
+			Func:        handlerArtistExplore,
+		},
+		RequestHandler{
+			Method:      "POST",
+			PathPattern: "^" + settings.UriPrefix + "/api/record$",
+			Func:        handlerRecordPlay,
+		},
+		RequestHandler{
+			Method:      "POST",
+			PathPattern: "^" + settings.UriPrefix + "/api/record-batch$",
+			Func:        handlerRecordBatch,
+		},
+		RequestHandler{
+			Method:      "POST",
+			PathPattern: "^" + settings.UriPrefix + "/import/plays$",
+			Func:        handlerImportPlays,
+			Timeout:     longRequestTimeout,
+		},
 	}
 
-	// find a matching handler.
+	if settings.EnablePprof {
+		handlers = append(handlers, pprofHandlers(settings)...)
+	}
+	return handlers
+}
+
+// compileHandlers compiles the path pattern of each handler. we do this
+// once at startup rather than on every request.
+func compileHandlers(handlers []RequestHandler) ([]RequestHandler, error) {
+	var compiled []RequestHandler
 	for _, actionHandler := range handlers {
-		if actionHandler.Method != request.Method {
-			continue
-		}
-		matched, err := regexp.MatchString(actionHandler.PathPattern,
-			request.URL.Path)
+		re, err := regexp.Compile(actionHandler.PathPattern)
 		if err != nil {
-			log.Printf("Error matching regex: %s", err.Error())
-			continue
-		}
-		if matched {
-			actionHandler.Func(rw, request, handler.settings)
-			return
+			return nil, fmt.Errorf("Invalid path pattern: %s: %s",
+				actionHandler.PathPattern, err.Error())
 		}
+		actionHandler.compiledPattern = re
+		compiled = append(compiled, actionHandler)
 	}
-
-	// there was no matching handler - send a 404.
-	log.Printf("No handler for this request.")
-	rw.WriteHeader(http.StatusNotFound)
-	rw.Write([]byte("404 Not Found"))
+	return compiled, nil
 }
 
 // main is the entry point of the program.
@@ -413,53 +2257,213 @@ func main() {
 		"Path to a configuration file.")
 	logPath := flag.String("log-file", "",
 		"Path to a log file.")
+	logFormat := flag.String("log-format", "text",
+		"Log format. Must be one of 'text' or 'json'.")
 	flag.Parse()
+	// with the migrate command, we apply database migrations and exit
+	// rather than serving requests.
+	migrate := flag.Arg(0) == "migrate"
 	// config file is required.
 	if len(*configPath) == 0 {
 		log.Print("You must specify a configuration file.")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	if len(*logPath) == 0 {
+	if len(*logPath) == 0 && !migrate {
 		log.Print("You must specify a log file.")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	if *logFormat != "text" && *logFormat != "json" {
+		log.Print("Invalid log format.")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
 
-	// open log file.
+	// open log file. if we are migrating we may not have one, in which case
+	// we log to stderr.
 	// don't use os.Create() because that truncates.
-	logFh, err := os.OpenFile(*logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		log.Printf("Failed to open log file: %s: %s", *logPath, err.Error())
-		os.Exit(1)
+	var logOut io.Writer = os.Stderr
+	if len(*logPath) > 0 {
+		logFh, err := os.OpenFile(*logPath,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Printf("Failed to open log file: %s: %s", *logPath, err.Error())
+			os.Exit(1)
+		}
+		logOut = logFh
+	}
+	if *logFormat == "json" {
+		// the json writer adds its own timestamp.
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{out: logOut})
+	} else {
+		log.SetOutput(logOut)
 	}
-	log.SetOutput(logFh)
 
 	// load up our settings.
-	var settings Config
-	err = config.GetConfig(*configPath, &settings)
+	settings, err := loadConfig(*configPath)
 	if err != nil {
 		log.Printf("Failed to retrieve config: %s", err.Error())
 		os.Exit(1)
 	}
 
+	if migrate {
+		db, err := connectToDb(settings)
+		if err != nil {
+			os.Exit(1)
+		}
+		err = runMigrations(db)
+		db.Close()
+		if err != nil {
+			log.Printf("Failed to apply migrations: %s", err.Error())
+			os.Exit(1)
+		}
+		log.Print("Migrations are up to date.")
+		os.Exit(0)
+	}
+
+	err = checkTLSFiles(settings)
+	if err != nil {
+		log.Print(err.Error())
+		os.Exit(1)
+	}
+
 	// start listening.
-	var listenHostPort = fmt.Sprintf("%s:%d", settings.ListenHost,
-		settings.ListenPort)
-	listener, err := net.Listen("tcp", listenHostPort)
+	listener, err := listen(settings)
 	if err != nil {
-		log.Print("Failed to open port: " + err.Error())
+		log.Print("Failed to listen: " + err.Error())
 		os.Exit(1)
 	}
+	log.Printf("Listening on %s", listener.Addr())
 
-	httpHandler := HttpHandler{settings: &settings}
+	slowQueryThreshold = time.Duration(settings.SlowQueryThresholdMs) *
+		time.Millisecond
+
+	if len(settings.apiKeys()) == 0 {
+		log.Printf("Warning: No APIKeys set. Requests are not authenticated.")
+	}
+
+	handlers, err := compileHandlers(getHandlers(settings))
+	if err != nil {
+		log.Printf("Failed to set up handlers: %s", err.Error())
+		os.Exit(1)
+	}
 
-	// XXX: this will serve requests forever - should we have a signal
-	//   or a method to cause this to gracefully stop?
-	log.Print("Starting to serve requests.")
-	err = fcgi.Serve(listener, httpHandler)
+	// sql.Open() gives us a pool of connections. we share it between all
+	// requests.
+	db, err := connectToDb(settings)
 	if err != nil {
-		log.Print("Failed to start serving HTTP: " + err.Error())
 		os.Exit(1)
 	}
+	configureDbPool(db, settings)
+
+	server := &Server{
+		configPath: *configPath,
+		inFlight:   &sync.WaitGroup{},
+		cache:      newCache(time.Duration(settings.CacheTTLSeconds) * time.Second),
+	}
+	server.state.Store(&serverState{
+		settings: settings,
+		db:       db,
+		handlers: handlers,
+	})
+
+	// we serve requests until we receive a signal telling us to stop.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT,
+		syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP tells us to reload our config.
+	go server.reloadOnSignal(ctx)
+
+	// in HTTP mode we use an http.Server so that we can shut it down
+	// gracefully.
+	var httpServer *http.Server
+	if settings.ServeMode == serveModeHTTP {
+		httpServer = &http.Server{Handler: server}
+	}
+
+	serveErrors := make(chan error, 1)
+	go func() {
+		log.Printf("Starting to serve requests. Mode: %s", settings.ServeMode)
+		serveErrors <- serve(listener, server, httpServer, settings)
+	}()
+
+	select {
+	case err := <-serveErrors:
+		log.Print("Failed to serve requests: " + err.Error())
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	log.Print("Received signal. Shutting down.")
+	state := server.state.Load()
+	server.shutdown(listener, httpServer,
+		time.Duration(state.settings.ShutdownTimeoutSeconds)*time.Second)
+	os.Exit(0)
+}
+
+// serve accepts connections on the listener and serves requests on them
+// with the handler until the listener is closed. we speak FastCGI or HTTP
+// depending on the ServeMode setting, and HTTPS if we have a certificate.
+// in HTTP mode we serve with the given http.Server.
+func serve(listener net.Listener, handler http.Handler,
+	httpServer *http.Server, settings *Config) error {
+	if settings.ServeMode == serveModeHTTP {
+		if settings.tlsEnabled() {
+			return httpServer.ServeTLS(listener, settings.TLSCertFile,
+				settings.TLSKeyFile)
+		}
+		return httpServer.Serve(listener)
+	}
+	return fcgi.Serve(listener, handler)
+}
+
+// shutdown stops us accepting new connections, and then waits up to the
+// given timeout for in-flight requests to complete. we close the database
+// connection once we are done waiting.
+//
+// in HTTP mode, the http.Server closes idle connections and waits for
+// active ones. with FastCGI we can only close the listener. the web
+// server may keep sending requests on connections it has open, so once we
+// start waiting we refuse those.
+func (server *Server) shutdown(listener net.Listener,
+	httpServer *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if httpServer != nil {
+		err := httpServer.Shutdown(ctx)
+		if err != nil {
+			log.Printf("Failed to shut down HTTP server: %s", err.Error())
+		}
+	} else {
+		err := listener.Close()
+		if err != nil {
+			log.Printf("Failed to close listener: %s", err.Error())
+		}
+	}
+
+	server.shutdownMutex.Lock()
+	server.shuttingDown = true
+	server.shutdownMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Print("All in-flight requests completed.")
+	case <-ctx.Done():
+		log.Print("Timed out waiting for in-flight requests to complete.")
+	}
+
+	err := server.state.Load().db.Close()
+	if err != nil {
+		log.Printf("Failed to close database connection: %s", err.Error())
+	}
 }
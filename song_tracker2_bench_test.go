@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+// seedBenchPlays adds the given number of plays by user 1, spread over
+// 1000 songs by 100 artists, one a minute going back from now.
+func seedBenchPlays(b *testing.B, db *sql.DB, plays int) {
+	_, err := db.Exec(`
+INSERT INTO song (artist, album, title, length_ms)
+SELECT 'Artist ' || (i % 100), 'Album ' || (i % 300), 'Title ' || i, 200000
+FROM generate_series(1, 1000) AS i
+`)
+	if err != nil {
+		b.Fatalf("unable to add songs: %s", err)
+	}
+
+	_, err = db.Exec(`
+INSERT INTO play (user_id, song_id, create_time)
+SELECT 1, (i % 1000) + 1, current_timestamp - i * INTERVAL '1 minute'
+FROM generate_series(1, $1) AS i
+`, plays)
+	if err != nil {
+		b.Fatalf("unable to add plays: %s", err)
+	}
+
+	_, err = db.Exec("ANALYZE play, song")
+	if err != nil {
+		b.Fatalf("unable to analyze: %s", err)
+	}
+}
+
+func BenchmarkRetrieveAndMarshalTopArtists(b *testing.B) {
+	db := openTestDb(b)
+	seedBenchPlays(b, db, 100000)
+
+	ctx := context.Background()
+	params := &TopParameters{UserId: 1, Limit: 100, DaysBack: -1}
+
+	// no cache, so each call queries.
+	results, _, err := retrieveTopArtists(ctx, db, nil, params)
+	if err != nil {
+		b.Fatalf("unable to retrieve top artists: %s", err)
+	}
+
+	b.Run("query", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _, err := retrieveTopArtists(ctx, db, nil, params)
+			if err != nil {
+				b.Fatalf("unable to retrieve top artists: %s", err)
+			}
+		}
+	})
+
+	b.Run("marshal", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := json.Marshal(results)
+			if err != nil {
+				b.Fatalf("unable to marshal: %s", err)
+			}
+		}
+	})
+
+	b.Run("query_and_marshal", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			results, _, err := retrieveTopArtists(ctx, db, nil, params)
+			if err != nil {
+				b.Fatalf("unable to retrieve top artists: %s", err)
+			}
+			_, err = json.Marshal(results)
+			if err != nil {
+				b.Fatalf("unable to marshal: %s", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,142 @@
+//go:build integration
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// seedPlays adds a play by the user of a song by the artist for each of
+// the times given, as how long ago the play was.
+func seedPlays(t testing.TB, db *sql.DB, userId int64, artist string,
+	agos ...time.Duration) {
+	var songId int64
+	err := db.QueryRow(`
+INSERT INTO song (artist, album, title, length_ms)
+VALUES ($1, 'Album', 'Title', 1000)
+RETURNING id
+`, artist).Scan(&songId)
+	if err != nil {
+		t.Fatalf("unable to add song: %s", err)
+	}
+
+	for _, ago := range agos {
+		_, err := db.Exec(`
+INSERT INTO play (user_id, song_id, create_time)
+VALUES ($1, $2, $3)
+`, userId, songId, time.Now().Add(-ago))
+		if err != nil {
+			t.Fatalf("unable to add play: %s", err)
+		}
+	}
+}
+
+// topArtistsResponse is the body of a top artists response.
+type topArtistsResponse struct {
+	Counts []TopResult
+	Total  int64 `json:"total"`
+}
+
+// requestTopArtists calls the top artists handler with the given query
+// string.
+func requestTopArtists(t *testing.T, db *sql.DB,
+	query string) *httptest.ResponseRecorder {
+	handler := &HttpHandler{
+		settings: &Config{TopLimitMax: 10},
+		db:       db,
+	}
+
+	request := httptest.NewRequest("GET", "/top/artists?"+query, nil)
+	recorder := httptest.NewRecorder()
+	handlerTopArtists(recorder, request, handler)
+	return recorder
+}
+
+func TestTopArtistsIntegration(t *testing.T) {
+	db := openTestDb(t)
+
+	day := 24 * time.Hour
+	seedPlays(t, db, 1, "Often", time.Hour, 2*time.Hour, 3*time.Hour)
+	seedPlays(t, db, 1, "Sometimes", time.Hour, 2*time.Hour)
+	seedPlays(t, db, 1, "Long Ago", 30*day, 31*day, 32*day, 33*day)
+	seedPlays(t, db, 2, "Other User", time.Hour)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []TopResult
+		total int64
+	}{
+		{
+			name:  "all time",
+			query: "user_id=1&limit=10",
+			want: []TopResult{
+				{Count: 4, Label: "Long Ago"},
+				{Count: 3, Label: "Often"},
+				{Count: 2, Label: "Sometimes"},
+			},
+			total: 3,
+		},
+		{
+			name:  "days back",
+			query: "user_id=1&limit=10&days_back=7",
+			want: []TopResult{
+				{Count: 3, Label: "Often"},
+				{Count: 2, Label: "Sometimes"},
+			},
+			total: 2,
+		},
+		{
+			name:  "limit",
+			query: "user_id=1&limit=1",
+			want: []TopResult{
+				{Count: 4, Label: "Long Ago"},
+			},
+			total: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := requestTopArtists(t, db, test.query)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %d, wanted 200: %s", recorder.Code,
+					recorder.Body.String())
+			}
+
+			var response topArtistsResponse
+			err := json.Unmarshal(recorder.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("invalid JSON: %s: %s", err, recorder.Body.String())
+			}
+
+			if response.Total != test.total {
+				t.Errorf("got total %d, wanted %d", response.Total, test.total)
+			}
+			if len(response.Counts) != len(test.want) {
+				t.Fatalf("got %+v, wanted %+v", response.Counts, test.want)
+			}
+			for i := range test.want {
+				if response.Counts[i] != test.want[i] {
+					t.Errorf("result %d: got %+v, wanted %+v", i,
+						response.Counts[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTopArtistsIntegrationLimitTooHigh(t *testing.T) {
+	db := openTestDb(t)
+
+	recorder := requestTopArtists(t, db, "user_id=1&limit=11")
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, wanted 400: %s", recorder.Code,
+			recorder.Body.String())
+	}
+}
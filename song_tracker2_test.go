@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetParametersTopRequest(t *testing.T) {
+	settings := &Config{TopLimitMax: 100}
+
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+		want    TopParameters
+	}{
+		{
+			name:    "missing user_id",
+			query:   "limit=10",
+			wantErr: true,
+		},
+		{
+			name:    "negative user_id",
+			query:   "user_id=-1&limit=10",
+			wantErr: true,
+		},
+		{
+			name:    "missing limit",
+			query:   "user_id=1",
+			wantErr: true,
+		},
+		{
+			name:    "limit is 0",
+			query:   "user_id=1&limit=0",
+			wantErr: true,
+		},
+		{
+			name:    "limit over TopLimitMax",
+			query:   "user_id=1&limit=101",
+			wantErr: true,
+		},
+		{
+			name:    "days_back is 0",
+			query:   "user_id=1&limit=10&days_back=0",
+			wantErr: true,
+		},
+		{
+			name:  "days_back not given",
+			query: "user_id=1&limit=10",
+			want:  TopParameters{UserId: 1, Limit: 10, DaysBack: -1},
+		},
+		{
+			name:  "valid",
+			query: "user_id=2&limit=100&offset=5&days_back=7",
+			want: TopParameters{UserId: 2, Limit: 100, Offset: 5,
+				DaysBack: 7},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/top/artists?"+test.query, nil)
+
+			params, err := getParametersTopRequest(request, settings)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, wanted error", params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if *params != test.want {
+				t.Errorf("got %+v, wanted %+v", *params, test.want)
+			}
+		})
+	}
+}
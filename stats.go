@@ -0,0 +1,1739 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeatmapResult holds play counts by day of week and hour of day.
+type HeatmapResult struct {
+	// indexed by [day of week][hour of day]. day 0 is Sunday.
+	Matrix [7][24]int64 `json:"matrix"`
+	// the time zone the days and hours are in.
+	Tz string `json:"tz"`
+}
+
+// retrieveHeatmap counts the given user's plays by day of week and hour of
+// day (in UTC) over the given number of days back. if days back is -1, we
+// count plays for all time.
+// every day and hour is present in the result, even if there were no
+// plays then.
+func retrieveHeatmap(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64) (*HeatmapResult, error) {
+	defer observeQuery("heatmap", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	query := `
+SELECT
+EXTRACT(DOW FROM create_time AT TIME ZONE 'UTC') AS dow,
+EXTRACT(HOUR FROM create_time AT TIME ZONE 'UTC') AS hour,
+COUNT(*) AS count
+FROM play
+WHERE
+user_id = $1
+AND create_time > current_timestamp - CAST($2 AS INTERVAL)
+GROUP BY dow, hour
+`
+	rows, err := db.QueryContext(ctx, query, userId, daysBackInterval(daysBack))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &HeatmapResult{Tz: "UTC"}
+	for rows.Next() {
+		var dow, hour float64
+		var count int64
+		err := rows.Scan(&dow, &hour, &count)
+		if err != nil {
+			return nil, err
+		}
+		if dow < 0 || dow > 6 || hour < 0 || hour > 23 {
+			return nil, fmt.Errorf("Unexpected day [%f] or hour [%f]", dow, hour)
+		}
+		result.Matrix[int(dow)][int(hour)] = count
+	}
+	return result, rows.Err()
+}
+
+// handlerHeatmap looks up when a user listens, by day of week and hour.
+func handlerHeatmap(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, daysBack, err := getParametersUserDaysBack(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	heatmap, err := retrieveHeatmap(request.Context(), handler.db, userId,
+		daysBack)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve heatmap: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, heatmap)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// HourCount is how many plays there were in an hour of the day.
+type HourCount struct {
+	Hour  int64 `json:"hour"`
+	Count int64 `json:"count"`
+}
+
+// DOWCount is how many plays there were on a day of the week. day 0 is
+// Sunday.
+type DOWCount struct {
+	DOW   int64 `json:"dow"`
+	Count int64 `json:"count"`
+}
+
+// retrievePlaysByTimeField counts the given user's plays by a field of the
+// play time (in UTC), such as the hour. the field's values must be 0 to
+// size-1. we return a count for each value, even if there were no plays
+// then.
+// field is part of the query, so it must be a fixed string.
+func retrievePlaysByTimeField(ctx context.Context, db *sql.DB, field string,
+	size int, userId int64, daysBack int64) ([]int64, error) {
+	query := `
+SELECT
+EXTRACT(` + field + ` FROM create_time AT TIME ZONE 'UTC') AS value,
+COUNT(*) AS count
+FROM play
+WHERE
+user_id = $1
+AND create_time > current_timestamp - CAST($2 AS INTERVAL)
+GROUP BY value
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		daysBackInterval(daysBack))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]int64, size)
+	for rows.Next() {
+		var value float64
+		var count int64
+		err := rows.Scan(&value, &count)
+		if err != nil {
+			return nil, err
+		}
+		if value < 0 || int(value) >= size {
+			return nil, fmt.Errorf("Unexpected %s [%f]", field, value)
+		}
+		counts[int(value)] = count
+	}
+	return counts, rows.Err()
+}
+
+// retrievePlaysByHour counts the given user's plays by hour of the day (in
+// UTC) over the given number of days back. if days back is -1, we count
+// plays for all time.
+func retrievePlaysByHour(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64) ([]HourCount, error) {
+	defer observeQuery("plays_by_hour", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	counts, err := retrievePlaysByTimeField(ctx, db, "HOUR", 24, userId,
+		daysBack)
+	if err != nil {
+		return nil, err
+	}
+	var hours []HourCount
+	for hour, count := range counts {
+		hours = append(hours, HourCount{Hour: int64(hour), Count: count})
+	}
+	return hours, nil
+}
+
+// retrievePlaysByDOW counts the given user's plays by day of the week (in
+// UTC) over the given number of days back. if days back is -1, we count
+// plays for all time.
+func retrievePlaysByDOW(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64) ([]DOWCount, error) {
+	defer observeQuery("plays_by_dow", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	counts, err := retrievePlaysByTimeField(ctx, db, "DOW", 7, userId,
+		daysBack)
+	if err != nil {
+		return nil, err
+	}
+	var days []DOWCount
+	for dow, count := range counts {
+		days = append(days, DOWCount{DOW: int64(dow), Count: count})
+	}
+	return days, nil
+}
+
+// handlerPlaysByHour looks up when in the day a user listens.
+func handlerPlaysByHour(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, daysBack, err := getParametersUserDaysBack(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	hours, err := retrievePlaysByHour(request.Context(), handler.db, userId,
+		daysBack)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve plays by hour: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	type PlaysByHourResponse struct {
+		Hours []HourCount `json:"hours"`
+	}
+	err = sendJSONResponse(rw, http.StatusOK, PlaysByHourResponse{Hours: hours})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// handlerPlaysByDOW looks up which days of the week a user listens.
+func handlerPlaysByDOW(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, daysBack, err := getParametersUserDaysBack(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	days, err := retrievePlaysByDOW(request.Context(), handler.db, userId,
+		daysBack)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve plays by day of week: %s",
+			err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	type PlaysByDOWResponse struct {
+		Days []DOWCount `json:"days"`
+	}
+	err = sendJSONResponse(rw, http.StatusOK, PlaysByDOWResponse{Days: days})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// DecadeCount is how many plays there were of songs released in a decade,
+// such as 1990 for 1990 to 1999.
+type DecadeCount struct {
+	Decade int64 `json:"decade"`
+	Count  int64 `json:"count"`
+}
+
+// retrievePlaysByDecade counts the given user's plays by the decade the
+// songs were released over the given number of days back. if days back is
+// -1, we count plays for all time. we leave out songs whose year we do not
+// know.
+func retrievePlaysByDecade(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64) ([]DecadeCount, error) {
+	defer observeQuery("plays_by_decade", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	query := `
+SELECT
+s.year / 10 * 10 AS decade,
+COUNT(*) AS count
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.year > 0
+AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+GROUP BY decade
+ORDER BY decade
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		daysBackInterval(daysBack))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decades := []DecadeCount{}
+	for rows.Next() {
+		var decade DecadeCount
+		err := rows.Scan(&decade.Decade, &decade.Count)
+		if err != nil {
+			return nil, err
+		}
+		decades = append(decades, decade)
+	}
+	return decades, rows.Err()
+}
+
+// handlerPlaysByDecade looks up which decades' music a user listens to.
+func handlerPlaysByDecade(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, daysBack, err := getParametersUserDaysBack(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	decades, err := retrievePlaysByDecade(request.Context(), handler.db,
+		userId, daysBack)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve plays by decade: %s",
+			err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	type PlaysByDecadeResponse struct {
+		Decades []DecadeCount `json:"decades"`
+	}
+	err = sendJSONResponse(rw, http.StatusOK,
+		PlaysByDecadeResponse{Decades: decades})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// yearReviewTopLimit is how many top artists and songs we include in a
+// year in review.
+const yearReviewTopLimit = 5
+
+// YearReview summarises a user's listening over a calendar year.
+type YearReview struct {
+	UserId        int64       `json:"user_id"`
+	Year          int64       `json:"year"`
+	TotalPlays    int64       `json:"total_plays"`
+	UniqueArtists int64       `json:"unique_artists"`
+	UniqueAlbums  int64       `json:"unique_albums"`
+	UniqueSongs   int64       `json:"unique_songs"`
+	TopArtists    []TopResult `json:"top_artists"`
+	TopSongs      []TopResult `json:"top_songs"`
+	// the day (YYYY-MM-DD, UTC) with the most plays, and how many.
+	MostActiveDay      string `json:"most_active_day,omitempty"`
+	MostActiveDayPlays int64  `json:"most_active_day_plays"`
+	// RFC3339. these are blank if there were no plays.
+	FirstPlay string `json:"first_play,omitempty"`
+	LastPlay  string `json:"last_play,omitempty"`
+}
+
+// getParametersYearReview retrieves and validates parameters to a year in
+// review request.
+// we return: user_id, year.
+func getParametersYearReview(request *http.Request) (int64, int64, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	year, exists, err := getIntParameter(request, "year")
+	if err != nil {
+		return 0, 0, err
+	}
+	if !exists {
+		return 0, 0, errors.New("No year given")
+	}
+	if year < 1000 || year > 9999 {
+		return 0, 0, errors.New("Invalid year")
+	}
+	logger.Printf("Parameters: user_id [%d] year [%d]", userId, year)
+	return userId, year, nil
+}
+
+// retrieveYearReview gathers a user's listening statistics for the given
+// calendar year (in UTC).
+func retrieveYearReview(ctx context.Context, db *sql.DB, userId int64,
+	year int64) (*YearReview, error) {
+	defer observeQuery("year_review", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	start := time.Date(int(year), time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+
+	review := &YearReview{UserId: userId, Year: year}
+
+	query := `
+SELECT
+COUNT(*),
+COUNT(DISTINCT s.artist),
+COUNT(DISTINCT (s.artist, s.album)),
+COUNT(DISTINCT p.song_id),
+MIN(p.create_time),
+MAX(p.create_time)
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND p.create_time >= $2
+AND p.create_time < $3
+`
+	var firstPlay, lastPlay sql.NullTime
+	err := db.QueryRowContext(ctx, query, userId, start, end).Scan(
+		&review.TotalPlays, &review.UniqueArtists, &review.UniqueAlbums,
+		&review.UniqueSongs, &firstPlay, &lastPlay)
+	if err != nil {
+		return nil, err
+	}
+	if review.TotalPlays == 0 {
+		review.TopArtists = []TopResult{}
+		review.TopSongs = []TopResult{}
+		return review, nil
+	}
+	review.FirstPlay = firstPlay.Time.Format(time.RFC3339)
+	review.LastPlay = lastPlay.Time.Format(time.RFC3339)
+
+	query = `
+SELECT
+COUNT(*) AS count,
+s.artist AS label
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.artist != 'N/A'
+AND p.create_time >= $2
+AND p.create_time < $3
+GROUP BY s.artist
+ORDER BY count DESC
+LIMIT $4
+`
+	review.TopArtists, err = queryTopResults(ctx, db, query, userId, start, end,
+		yearReviewTopLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+SELECT
+COUNT(*) AS count,
+CONCAT(s.artist, ' - ', s.title) AS label
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND p.create_time >= $2
+AND p.create_time < $3
+GROUP BY label
+ORDER BY count DESC
+LIMIT $4
+`
+	review.TopSongs, err = queryTopResults(ctx, db, query, userId, start, end,
+		yearReviewTopLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+SELECT
+TO_CHAR(p.create_time AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day,
+COUNT(*) AS count
+FROM play p
+WHERE
+p.user_id = $1
+AND p.create_time >= $2
+AND p.create_time < $3
+GROUP BY day
+ORDER BY count DESC, day
+LIMIT 1
+`
+	err = db.QueryRowContext(ctx, query, userId, start, end).Scan(
+		&review.MostActiveDay, &review.MostActiveDayPlays)
+	if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+// handlerYearReview summarises a user's listening over a year.
+func handlerYearReview(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, year, err := getParametersYearReview(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	review, err := retrieveYearReview(request.Context(), handler.db, userId,
+		year)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve year review: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, review)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// StreakResult describes a user's daily listening streaks. a streak is a
+// run of consecutive days (in UTC) with at least one play.
+type StreakResult struct {
+	// the streak running through today or yesterday. 0 if there is none.
+	CurrentStreakDays int64 `json:"current_streak_days"`
+	LongestStreakDays int64 `json:"longest_streak_days"`
+	// the first and last days (YYYY-MM-DD) of the longest streak. if there
+	// are several equally long, this is the most recent. blank if the user
+	// has no plays.
+	StreakStart string `json:"streak_start,omitempty"`
+	StreakEnd   string `json:"streak_end,omitempty"`
+}
+
+// retrieveStreak finds the given user's current and longest daily
+// listening streaks.
+func retrieveStreak(ctx context.Context, db *sql.DB,
+	userId int64) (*StreakResult, error) {
+	defer observeQuery("streak", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	// each distinct day minus its row number is constant across a run of
+	// consecutive days, so grouping by that gives us each streak.
+	query := `
+WITH days AS (
+	SELECT DISTINCT DATE(create_time AT TIME ZONE 'UTC') AS day
+	FROM play
+	WHERE user_id = $1
+),
+streaks AS (
+	SELECT
+	day,
+	day - CAST(ROW_NUMBER() OVER (ORDER BY day) AS INTEGER) AS streak
+	FROM days
+)
+SELECT
+MIN(day) AS streak_start,
+MAX(day) AS streak_end,
+COUNT(*) AS days
+FROM streaks
+GROUP BY streak
+ORDER BY streak_start
+`
+	rows, err := db.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &StreakResult{}
+	var lastEnd time.Time
+	var lastDays int64
+	for rows.Next() {
+		var start, end time.Time
+		var days int64
+		err := rows.Scan(&start, &end, &days)
+		if err != nil {
+			return nil, err
+		}
+		if days >= result.LongestStreakDays {
+			result.LongestStreakDays = days
+			result.StreakStart = start.Format("2006-01-02")
+			result.StreakEnd = end.Format("2006-01-02")
+		}
+		lastEnd = end
+		lastDays = days
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// the most recent streak is current if it has not been broken yet, i.e.
+	// it ends today or the user has not listened yet today.
+	today := time.Now().UTC().Format("2006-01-02")
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	if lastDays > 0 {
+		lastEndDay := lastEnd.Format("2006-01-02")
+		if lastEndDay == today || lastEndDay == yesterday {
+			result.CurrentStreakDays = lastDays
+		}
+	}
+	return result, nil
+}
+
+// handlerStreak looks up a user's daily listening streaks.
+func handlerStreak(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, err := getParametersUserId(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	streak, err := retrieveStreak(request.Context(), handler.db, userId)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve streak: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, streak)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// DiversityResult describes how evenly a user's plays are spread across
+// artists.
+type DiversityResult struct {
+	// Simpson's diversity index. close to 1 means plays are spread across
+	// many artists. close to 0 means one artist dominates.
+	Score       float64 `json:"score"`
+	ArtistCount int64   `json:"artist_count"`
+	TotalPlays  int64   `json:"total_plays"`
+}
+
+// retrieveDiversity computes the diversity of the given user's plays
+// across artists over the given number of days back. if days back is -1,
+// we look at all time.
+//
+// the score is 1 - sum(p_i^2), where p_i is the fraction of plays that
+// were of artist i.
+func retrieveDiversity(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64) (*DiversityResult, error) {
+	defer observeQuery("diversity", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	query := `
+SELECT COUNT(*)
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.artist != 'N/A'
+AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+GROUP BY s.artist
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		daysBackInterval(daysBack))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []int64
+	result := &DiversityResult{}
+	for rows.Next() {
+		var count int64
+		err := rows.Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+		result.TotalPlays += count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	result.ArtistCount = int64(len(counts))
+	if result.TotalPlays == 0 {
+		return result, nil
+	}
+
+	sum := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(result.TotalPlays)
+		sum += p * p
+	}
+	result.Score = 1 - sum
+	return result, nil
+}
+
+// handlerDiversity looks up how diverse a user's listening is.
+func handlerDiversity(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, daysBack, err := getParametersUserDaysBack(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	diversity, err := retrieveDiversity(request.Context(), handler.db, userId,
+		daysBack)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve diversity: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, diversity)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// milestoneThresholds are the play counts of a song we consider
+// milestones.
+var milestoneThresholds = []int64{10, 50, 100, 500}
+
+// milestonesLimitDefault is how many milestones we list if no limit is
+// given.
+const milestonesLimitDefault = 50
+
+// Milestone is a song reaching a number of plays.
+type Milestone struct {
+	Artist    string `json:"artist"`
+	Title     string `json:"title"`
+	Milestone int64  `json:"milestone"`
+	// RFC3339. when the song reached the milestone.
+	AchievedAt string `json:"achieved_at"`
+}
+
+// MilestonesResponse is the body we send in response to a milestones
+// request.
+type MilestonesResponse struct {
+	Milestones []Milestone `json:"milestones"`
+}
+
+// getParametersMilestones retrieves and validates parameters to a
+// milestones request.
+// we return: user_id, song_id (-1 for all songs), limit.
+func getParametersMilestones(request *http.Request) (int64, int64, int64,
+	error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	songId, exists, err := getIntParameter(request, "song_id")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if !exists {
+		songId = -1
+	} else if songId < 1 {
+		return 0, 0, 0, errors.New("Invalid song ID")
+	}
+	limit, err := getOptionalLimitParameter(request, milestonesLimitDefault,
+		recentPlaysLimitMax)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	logger.Printf("Parameters: user_id [%d] song_id [%d] limit [%d]", userId,
+		songId, limit)
+	return userId, songId, limit, nil
+}
+
+// retrieveMilestones finds when the given user's songs reached each of the
+// milestone play counts, most recent first. if song ID is -1, we look at
+// all of the user's songs.
+func retrieveMilestones(ctx context.Context, db *sql.DB, userId int64,
+	songId int64, limit int64) ([]Milestone, error) {
+	defer observeQuery("milestones", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", userId, limit))
+
+	var thresholds []string
+	for _, threshold := range milestoneThresholds {
+		thresholds = append(thresholds, strconv.FormatInt(threshold, 10))
+	}
+
+	// a song ID we were not given is NULL and so does not restrict anything.
+	var songIdParam interface{}
+	if songId != -1 {
+		songIdParam = songId
+	}
+
+	// number each song's plays in order. the play numbered N is when the
+	// song reached N plays.
+	query := `
+SELECT
+s.artist,
+s.title,
+n.play_number,
+n.create_time
+FROM (
+	SELECT
+	p.song_id,
+	p.create_time,
+	ROW_NUMBER() OVER (
+		PARTITION BY p.song_id ORDER BY p.create_time, p.id
+	) AS play_number
+	FROM play p
+	WHERE
+	p.user_id = $1
+	AND (CAST($2 AS INTEGER) IS NULL OR p.song_id = $2)
+) n
+JOIN song s
+ON n.song_id = s.id
+WHERE n.play_number IN (` + strings.Join(thresholds, ", ") + `)
+ORDER BY n.create_time DESC
+LIMIT $3
+`
+	rows, err := db.QueryContext(ctx, query, userId, songIdParam, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	milestones := []Milestone{}
+	for rows.Next() {
+		var milestone Milestone
+		var achievedAt time.Time
+		err := rows.Scan(&milestone.Artist, &milestone.Title,
+			&milestone.Milestone, &achievedAt)
+		if err != nil {
+			return nil, err
+		}
+		milestone.AchievedAt = achievedAt.Format(time.RFC3339)
+		milestones = append(milestones, milestone)
+	}
+	return milestones, rows.Err()
+}
+
+// handlerMilestones lists when a user's songs reached play count
+// milestones.
+func handlerMilestones(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, songId, limit, err := getParametersMilestones(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	milestones, err := retrieveMilestones(request.Context(), handler.db, userId,
+		songId, limit)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve milestones: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK,
+		MilestonesResponse{Milestones: milestones})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// NewArtistResult is an artist a user started listening to recently.
+type NewArtistResult struct {
+	Artist string `json:"artist"`
+	// RFC3339.
+	FirstPlay      string `json:"first_play"`
+	TotalPlaysEver int64  `json:"total_plays_ever"`
+	// plays within the days back we looked at.
+	TotalPlaysSince int64 `json:"total_plays_since"`
+}
+
+// retrieveNewArtists finds the artists the given user first played within
+// the given number of days back, most recently discovered first.
+func retrieveNewArtists(ctx context.Context, db *sql.DB, userId int64,
+	daysBack int64) ([]NewArtistResult, error) {
+	defer observeQuery("new_artists", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	query := `
+SELECT
+s.artist,
+MIN(p.create_time) AS first_play,
+COUNT(*) AS total_plays_ever,
+COUNT(*) FILTER (
+	WHERE p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+) AS total_plays_since
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.artist != 'N/A'
+GROUP BY s.artist
+HAVING MIN(p.create_time) > current_timestamp - CAST($2 AS INTERVAL)
+ORDER BY first_play DESC
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		daysBackInterval(daysBack))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	artists := []NewArtistResult{}
+	for rows.Next() {
+		var artist NewArtistResult
+		var firstPlay time.Time
+		err := rows.Scan(&artist.Artist, &firstPlay, &artist.TotalPlaysEver,
+			&artist.TotalPlaysSince)
+		if err != nil {
+			return nil, err
+		}
+		artist.FirstPlay = firstPlay.Format(time.RFC3339)
+		artists = append(artists, artist)
+	}
+	return artists, rows.Err()
+}
+
+// handlerNewArtists lists the artists a user recently started listening
+// to.
+func handlerNewArtists(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters. days back is required here.
+	userId, daysBack, err := getParametersUserDaysBack(request)
+	if err == nil && daysBack == -1 {
+		err = errors.New("No days back given")
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	artists, err := retrieveNewArtists(request.Context(), handler.db, userId,
+		daysBack)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve new artists: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	type NewArtistsResponse struct {
+		Artists []NewArtistResult `json:"artists"`
+	}
+	err = sendJSONResponse(rw, http.StatusOK,
+		NewArtistsResponse{Artists: artists})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// avgLengthLimitDefault is how many artists we list average lengths for
+// if no limit is given.
+const avgLengthLimitDefault = 50
+
+// AvgLengthResult is the average length of the songs a user played by an
+// artist.
+type AvgLengthResult struct {
+	Artist      string `json:"artist"`
+	AvgLengthMs int64  `json:"avg_length_ms"`
+	PlayCount   int64  `json:"play_count"`
+}
+
+// getParametersAvgLength retrieves and validates parameters to an average
+// length request.
+// we return: user_id, days back, limit.
+func getParametersAvgLength(request *http.Request,
+	settings *Config) (int64, int64, int64, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	daysBack, err := getDaysBackParameter(request)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	limit, err := getOptionalLimitParameter(request, avgLengthLimitDefault,
+		int64(settings.TopLimitMax))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	logger.Printf("Parameters: user_id [%d] days_back [%d] limit [%d]", userId,
+		daysBack, limit)
+	return userId, daysBack, limit, nil
+}
+
+// retrieveAvgLengthByArtist finds the average length of the songs the
+// given user played by each artist, longest first. we average over plays,
+// so songs played more count more. we skip songs we do not know the length
+// of.
+func retrieveAvgLengthByArtist(ctx context.Context, db *sql.DB,
+	userId int64, daysBack int64, limit int64) ([]AvgLengthResult, error) {
+	defer observeQuery("avg_length", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", userId, limit))
+
+	query := `
+SELECT
+s.artist,
+CAST(ROUND(AVG(s.length_ms)) AS BIGINT) AS avg_length_ms,
+COUNT(*) AS play_count
+FROM play p
+JOIN song s
+ON p.song_id = s.id
+WHERE
+p.user_id = $1
+AND s.artist != 'N/A'
+AND s.length_ms > 0
+AND p.create_time > current_timestamp - CAST($2 AS INTERVAL)
+GROUP BY s.artist
+ORDER BY avg_length_ms DESC
+LIMIT $3
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		daysBackInterval(daysBack), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []AvgLengthResult{}
+	for rows.Next() {
+		var result AvgLengthResult
+		err := rows.Scan(&result.Artist, &result.AvgLengthMs, &result.PlayCount)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// handlerAvgLength looks up the average length of the songs a user plays
+// by each artist.
+func handlerAvgLength(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, daysBack, limit, err := getParametersAvgLength(request,
+		handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	results, err := retrieveAvgLengthByArtist(request.Context(), handler.db,
+		userId, daysBack, limit)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve average lengths: %s",
+			err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, results)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// CompareParameters holds the parameters to a compare request.
+type CompareParameters struct {
+	UserIdA  int64
+	UserIdB  int64
+	Limit    int64
+	DaysBack int64
+}
+
+// SharedArtist is an artist in both users' top artists.
+type SharedArtist struct {
+	Artist string `json:"artist"`
+	PlaysA int64  `json:"plays_a"`
+	PlaysB int64  `json:"plays_b"`
+}
+
+// ArtistPlays is an artist in only one user's top artists.
+type ArtistPlays struct {
+	Artist string `json:"artist"`
+	Plays  int64  `json:"plays"`
+}
+
+// CompareResponse is the body we send in response to a compare request.
+// each list is in order of the user's top artists. shared is in user A's
+// order.
+type CompareResponse struct {
+	Shared []SharedArtist `json:"shared"`
+	OnlyA  []ArtistPlays  `json:"only_a"`
+	OnlyB  []ArtistPlays  `json:"only_b"`
+}
+
+// getCompareUserIdParameter retrieves one of the user IDs to a compare
+// request.
+func getCompareUserIdParameter(request *http.Request, name string) (int64,
+	error) {
+	userId, exists, err := getIntParameter(request, name)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, fmt.Errorf("No %s given", name)
+	}
+	if userId < 0 {
+		return 0, fmt.Errorf("Invalid %s", name)
+	}
+	return userId, nil
+}
+
+// getParametersCompare retrieves and validates parameters to a compare
+// request.
+func getParametersCompare(request *http.Request,
+	settings *Config) (*CompareParameters, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	userIdA, err := getCompareUserIdParameter(request, "user_id_a")
+	if err != nil {
+		return nil, err
+	}
+	userIdB, err := getCompareUserIdParameter(request, "user_id_b")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := getLimitParameter(request, int64(settings.TopLimitMax))
+	if err != nil {
+		return nil, err
+	}
+	daysBack, err := getDaysBackParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Parameters: user_id_a [%d] user_id_b [%d] limit [%d] days_back [%d]",
+		userIdA, userIdB, limit, daysBack)
+	return &CompareParameters{
+		UserIdA:  userIdA,
+		UserIdB:  userIdB,
+		Limit:    limit,
+		DaysBack: daysBack,
+	}, nil
+}
+
+// compareTopArtists splits two users' top artists into the ones they
+// share and the ones only one of them has.
+func compareTopArtists(topA []TopResult, topB []TopResult) *CompareResponse {
+	playsA := map[string]int64{}
+	for _, result := range topA {
+		playsA[result.Label] = result.Count
+	}
+	playsB := map[string]int64{}
+	for _, result := range topB {
+		playsB[result.Label] = result.Count
+	}
+
+	response := &CompareResponse{
+		Shared: []SharedArtist{},
+		OnlyA:  []ArtistPlays{},
+		OnlyB:  []ArtistPlays{},
+	}
+	for _, result := range topA {
+		if plays, ok := playsB[result.Label]; ok {
+			response.Shared = append(response.Shared, SharedArtist{
+				Artist: result.Label,
+				PlaysA: result.Count,
+				PlaysB: plays,
+			})
+			continue
+		}
+		response.OnlyA = append(response.OnlyA,
+			ArtistPlays{Artist: result.Label, Plays: result.Count})
+	}
+	for _, result := range topB {
+		if _, ok := playsA[result.Label]; ok {
+			continue
+		}
+		response.OnlyB = append(response.OnlyB,
+			ArtistPlays{Artist: result.Label, Plays: result.Count})
+	}
+	return response
+}
+
+// handlerCompare compares two users' top artists.
+func handlerCompare(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersCompare(request, handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	topA, _, err := retrieveTopArtists(request.Context(), handler.db,
+		handler.cache, &TopParameters{
+			UserId:   params.UserIdA,
+			Limit:    params.Limit,
+			DaysBack: params.DaysBack,
+		})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top artists: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	topB, _, err := retrieveTopArtists(request.Context(), handler.db,
+		handler.cache, &TopParameters{
+			UserId:   params.UserIdB,
+			Limit:    params.Limit,
+			DaysBack: params.DaysBack,
+		})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top artists: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, compareTopArtists(topA, topB))
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// dateRangeDaysMax is the most days a request for a day by day series may
+// cover.
+const dateRangeDaysMax = 3660
+
+// DailyPlayCount is how many plays there were on a day.
+type DailyPlayCount struct {
+	// YYYY-MM-DD, in UTC.
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// getDateRangeParameters retrieves the start_date and end_date parameters.
+// both are required. the range includes both days.
+func getDateRangeParameters(request *http.Request) (time.Time, time.Time,
+	error) {
+	start, exists, err := getDateParameter(request, "start_date")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !exists {
+		return time.Time{}, time.Time{}, errors.New("No start_date given")
+	}
+
+	end, exists, err := getDateParameter(request, "end_date")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !exists {
+		return time.Time{}, time.Time{}, errors.New("No end_date given")
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{},
+			errors.New("end_date is before start_date")
+	}
+	if end.Sub(start) >= dateRangeDaysMax*24*time.Hour {
+		return time.Time{}, time.Time{},
+			fmt.Errorf("The range may be at most %d days", dateRangeDaysMax)
+	}
+	return start, end, nil
+}
+
+// getParametersDailyPlays retrieves and validates parameters to a daily
+// plays request.
+// we return: user_id, start date, end date.
+func getParametersDailyPlays(request *http.Request) (int64, time.Time,
+	time.Time, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+	start, end, err := getDateRangeParameters(request)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+	logger.Printf("Parameters: user_id [%d] start_date [%s] end_date [%s]",
+		userId, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	return userId, start, end, nil
+}
+
+// retrieveDailyPlays counts the given user's plays on each day (in UTC)
+// from the start date to the end date. every day is present in the result,
+// even if there were no plays then.
+func retrieveDailyPlays(ctx context.Context, db *sql.DB, userId int64,
+	start time.Time, end time.Time) ([]DailyPlayCount, error) {
+	defer observeQuery("daily_plays", time.Now(),
+		fmt.Sprintf("user_id [%d] start_date [%s] end_date [%s]", userId,
+			start.Format("2006-01-02"), end.Format("2006-01-02")))
+
+	query := `
+SELECT
+CAST(d.date AS DATE),
+COALESCE(c.count, 0)
+FROM generate_series(CAST($2 AS DATE), CAST($3 AS DATE),
+	INTERVAL '1 day') AS d(date)
+LEFT JOIN (
+	SELECT
+	CAST(create_time AT TIME ZONE 'UTC' AS DATE) AS date,
+	COUNT(*) AS count
+	FROM play
+	WHERE
+	user_id = $1
+	AND create_time >= CAST($2 AS TIMESTAMP) AT TIME ZONE 'UTC'
+	AND create_time < (CAST($3 AS TIMESTAMP) + INTERVAL '1 day') AT TIME ZONE 'UTC'
+	GROUP BY 1
+) c
+ON c.date = CAST(d.date AS DATE)
+ORDER BY d.date
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := []DailyPlayCount{}
+	for rows.Next() {
+		var date time.Time
+		var day DailyPlayCount
+		err := rows.Scan(&date, &day.Count)
+		if err != nil {
+			return nil, err
+		}
+		day.Date = date.Format("2006-01-02")
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+// handlerDailyPlays looks up how many plays a user had each day.
+func handlerDailyPlays(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, start, end, err := getParametersDailyPlays(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	days, err := retrieveDailyPlays(request.Context(), handler.db, userId,
+		start, end)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve daily plays: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	type DailyPlaysResponse struct {
+		Days []DailyPlayCount `json:"days"`
+	}
+	err = sendJSONResponse(rw, http.StatusOK, DailyPlaysResponse{Days: days})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// rollingAverageWindowDaysDefault is how many days we average over if no
+// window is given.
+const rollingAverageWindowDaysDefault = 7
+
+// rollingAverageWindowDaysMax is the most days we average over.
+const rollingAverageWindowDaysMax = 365
+
+// RollingAverageDay is the play count on a day, and the average daily play
+// count over the window ending that day.
+type RollingAverageDay struct {
+	// YYYY-MM-DD, in UTC.
+	Date       string  `json:"date"`
+	DailyCount int64   `json:"daily_count"`
+	RollingAvg float64 `json:"rolling_avg"`
+}
+
+// getParametersRollingAverage retrieves and validates parameters to a
+// rolling average request.
+// we return: user_id, window days, start date, end date.
+func getParametersRollingAverage(request *http.Request) (int64, int64,
+	time.Time, time.Time, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, 0, time.Time{}, time.Time{}, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, 0, time.Time{}, time.Time{}, err
+	}
+	windowDays, err := getOptionalIntParameter(request, "window_days",
+		rollingAverageWindowDaysDefault, 1, rollingAverageWindowDaysMax)
+	if err != nil {
+		return 0, 0, time.Time{}, time.Time{}, err
+	}
+	start, end, err := getDateRangeParameters(request)
+	if err != nil {
+		return 0, 0, time.Time{}, time.Time{}, err
+	}
+	logger.Printf("Parameters: user_id [%d] window_days [%d] start_date [%s] end_date [%s]",
+		userId, windowDays, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	return userId, windowDays, start, end, nil
+}
+
+// retrieveRollingAverage finds the given user's play count on each day (in
+// UTC) from the start date to the end date, along with the average daily
+// count over the window of days ending then. every day is present in the
+// result, even if there were no plays then.
+//
+// the window for the first days reaches back before the start date, so
+// every average is over the full window.
+func retrieveRollingAverage(ctx context.Context, db *sql.DB, userId int64,
+	windowDays int64, start time.Time,
+	end time.Time) ([]RollingAverageDay, error) {
+	defer observeQuery("rolling_average", time.Now(),
+		fmt.Sprintf("user_id [%d] window_days [%d] start_date [%s] end_date [%s]",
+			userId, windowDays, start.Format("2006-01-02"),
+			end.Format("2006-01-02")))
+
+	// the window can reach back to here.
+	seriesStart := start.AddDate(0, 0, -int(windowDays-1))
+
+	query := `
+WITH counts AS (
+	SELECT
+	CAST(create_time AT TIME ZONE 'UTC' AS DATE) AS date,
+	COUNT(*) AS count
+	FROM play
+	WHERE
+	user_id = $1
+	AND create_time >= CAST($2 AS TIMESTAMP) AT TIME ZONE 'UTC'
+	AND create_time < (CAST($4 AS TIMESTAMP) + INTERVAL '1 day') AT TIME ZONE 'UTC'
+	GROUP BY 1
+),
+daily AS (
+	SELECT
+	CAST(d.date AS DATE) AS date,
+	COALESCE(c.count, 0) AS daily_count
+	FROM generate_series(CAST($2 AS DATE), CAST($4 AS DATE),
+		INTERVAL '1 day') AS d(date)
+	LEFT JOIN counts c
+	ON c.date = CAST(d.date AS DATE)
+),
+averages AS (
+	SELECT
+	date,
+	daily_count,
+	AVG(daily_count) OVER (
+		ORDER BY date
+		ROWS BETWEEN CAST($5 AS INTEGER) PRECEDING AND CURRENT ROW
+	) AS rolling_avg
+	FROM daily
+)
+SELECT date, daily_count, rolling_avg
+FROM averages
+WHERE date >= CAST($3 AS DATE)
+ORDER BY date
+`
+	rows, err := db.QueryContext(ctx, query, userId,
+		seriesStart.Format("2006-01-02"), start.Format("2006-01-02"),
+		end.Format("2006-01-02"), windowDays-1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := []RollingAverageDay{}
+	for rows.Next() {
+		var date time.Time
+		var day RollingAverageDay
+		err := rows.Scan(&date, &day.DailyCount, &day.RollingAvg)
+		if err != nil {
+			return nil, err
+		}
+		day.Date = date.Format("2006-01-02")
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+// handlerRollingAverage looks up a user's daily play count smoothed over a
+// window of days.
+func handlerRollingAverage(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, windowDays, start, end, err := getParametersRollingAverage(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	days, err := retrieveRollingAverage(request.Context(), handler.db, userId,
+		windowDays, start, end)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve rolling average: %s",
+			err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	type RollingAverageResponse struct {
+		Days []RollingAverageDay `json:"days"`
+	}
+	err = sendJSONResponse(rw, http.StatusOK,
+		RollingAverageResponse{Days: days})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// DiscographyCoverage describes how much of an artist's songs a user has
+// played.
+type DiscographyCoverage struct {
+	Artist string `json:"artist"`
+	// how many of the artist's songs the user played.
+	Played int64 `json:"played"`
+	// how many songs we know by the artist.
+	Total int64 `json:"total"`
+	// played as a fraction of total, from 0 to 1.
+	Coverage float64 `json:"coverage"`
+}
+
+// getParametersDiscographyCoverage retrieves and validates parameters to
+// a discography coverage request.
+// we return: user_id, artist.
+func getParametersDiscographyCoverage(request *http.Request) (int64,
+	string, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return 0, "", err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return 0, "", err
+	}
+	artist, err := getStringParameter(request, "artist")
+	if err != nil {
+		return 0, "", err
+	}
+	logger.Printf("Parameters: user_id [%d] artist [%s]", userId, artist)
+	return userId, artist, nil
+}
+
+// retrieveDiscographyCoverage finds how many of the songs we know by the
+// artist the given user has played. the artist must match exactly. we
+// know of songs the user has not played only if other users played them,
+// or they were imported.
+//
+// as when we recommend unplayed songs, we count songs with the same title
+// as one song, since the same song can exist on several albums or with
+// several lengths.
+func retrieveDiscographyCoverage(ctx context.Context, db *sql.DB,
+	userId int64, artist string) (*DiscographyCoverage, error) {
+	defer observeQuery("discography_coverage", time.Now(),
+		fmt.Sprintf("user_id [%d]", userId))
+
+	query := `
+SELECT
+COUNT(DISTINCT s.title) FILTER (
+	WHERE EXISTS (
+		SELECT 1
+		FROM play p
+		WHERE
+		p.user_id = $1
+		AND p.song_id = s.id
+	)
+) AS played,
+COUNT(DISTINCT s.title) AS total
+FROM song s
+WHERE
+s.artist = $2
+`
+	coverage := &DiscographyCoverage{Artist: artist}
+	err := db.QueryRowContext(ctx, query, userId, artist).Scan(
+		&coverage.Played, &coverage.Total)
+	if err != nil {
+		return nil, err
+	}
+	if coverage.Total > 0 {
+		coverage.Coverage = float64(coverage.Played) / float64(coverage.Total)
+	}
+	return coverage, nil
+}
+
+// handlerDiscographyCoverage looks up how much of an artist's songs a user
+// has heard.
+func handlerDiscographyCoverage(rw http.ResponseWriter,
+	request *http.Request, handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	userId, artist, err := getParametersDiscographyCoverage(request)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	coverage, err := retrieveDiscographyCoverage(request.Context(),
+		handler.db, userId, artist)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve discography coverage: %s",
+			err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK, coverage)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// truncateTestDb empties the tables the tests write to.
+func truncateTestDb(t testing.TB, db *sql.DB) {
+	_, err := db.Exec("TRUNCATE play, song RESTART IDENTITY")
+	if err != nil {
+		t.Errorf("unable to truncate tables: %s", err)
+	}
+}
+
+// openTestDb connects to the database in TEST_DB_DSN, brings its schema
+// up to date, and empties its tables. we empty them again when the test
+// finishes. we skip the test if there is no database.
+func openTestDb(t testing.TB) *sql.DB {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if len(dsn) == 0 {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("unable to open database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = runMigrations(db)
+	if err != nil {
+		t.Fatalf("unable to run migrations: %s", err)
+	}
+
+	truncateTestDb(t, db)
+	t.Cleanup(func() { truncateTestDb(t, db) })
+	return db
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// trendingLimitDefault is how many trending songs we return if no limit is
+// given.
+const trendingLimitDefault = 10
+
+// trendingDaysMax is the longest window or baseline we accept for trending
+// songs.
+const trendingDaysMax = 3650
+
+// TrendingParameters holds the parameters to a trending songs request.
+type TrendingParameters struct {
+	UserId int64
+	// the recent period we look at.
+	WindowDays int64
+	// the period before the window that we compare against.
+	BaselineDays int64
+	Limit        int64
+}
+
+// TrendingResult describes a song the user is playing more than usual.
+type TrendingResult struct {
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+	// plays in the window.
+	RecentCount int64 `json:"recent_count"`
+	// plays in the baseline period.
+	HistoricalCount int64 `json:"historical_count"`
+	// the play rate in the window relative to the rate in the baseline.
+	VelocityRatio float64 `json:"velocity_ratio"`
+}
+
+// TrendingResponse is the body we send in response to a trending songs
+// request.
+type TrendingResponse struct {
+	Songs []TrendingResult `json:"songs"`
+}
+
+// getParametersTrending retrieves and validates parameters to a trending
+// songs request.
+func getParametersTrending(request *http.Request,
+	settings *Config) (*TrendingParameters, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := getUserIdParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	windowDays, err := getOptionalIntParameter(request, "window_days", 7, 1,
+		trendingDaysMax)
+	if err != nil {
+		return nil, err
+	}
+	baselineDays, err := getOptionalIntParameter(request, "baseline_days", 30,
+		1, trendingDaysMax)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := getOptionalLimitParameter(request, trendingLimitDefault,
+		int64(settings.TopLimitMax))
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Parameters: user_id [%d] window_days [%d] baseline_days [%d] limit [%d]",
+		userId, windowDays, baselineDays, limit)
+	return &TrendingParameters{
+		UserId:       userId,
+		WindowDays:   windowDays,
+		BaselineDays: baselineDays,
+		Limit:        limit,
+	}, nil
+}
+
+// retrieveTrending finds the songs whose play rate over the last window
+// days is highest compared with their rate over the baseline days before
+// that.
+//
+// a song the user did not play during the baseline counts as having
+// been played once then. this way new favourites rank highly rather than
+// dividing by zero.
+func retrieveTrending(ctx context.Context, db *sql.DB,
+	params *TrendingParameters) ([]TrendingResult, error) {
+	defer observeQuery("trending", time.Now(),
+		fmt.Sprintf("user_id [%d] limit [%d]", params.UserId, params.Limit))
+
+	query := `
+SELECT
+artist,
+title,
+recent_count,
+historical_count,
+(CAST(recent_count AS FLOAT) / $2) /
+	(CAST(GREATEST(historical_count, 1) AS FLOAT) / $3) AS velocity_ratio
+FROM (
+	SELECT
+	s.artist,
+	s.title,
+	COUNT(*) FILTER (
+		WHERE p.create_time > current_timestamp - $2 * INTERVAL '1 day'
+	) AS recent_count,
+	COUNT(*) FILTER (
+		WHERE p.create_time <= current_timestamp - $2 * INTERVAL '1 day'
+	) AS historical_count
+	FROM play p
+	JOIN song s
+	ON p.song_id = s.id
+	WHERE
+	p.user_id = $1
+	AND p.create_time > current_timestamp - ($2 + $3) * INTERVAL '1 day'
+	GROUP BY s.artist, s.title
+) counts
+WHERE recent_count > 0
+ORDER BY velocity_ratio DESC, recent_count DESC
+LIMIT $4
+`
+	rows, err := db.QueryContext(ctx, query, params.UserId, params.WindowDays,
+		params.BaselineDays, params.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []TrendingResult{}
+	for rows.Next() {
+		var result TrendingResult
+		err := rows.Scan(&result.Artist, &result.Title, &result.RecentCount,
+			&result.HistoricalCount, &result.VelocityRatio)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// handlerTrending looks up the songs a user is playing more than usual.
+func handlerTrending(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersTrending(request, handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	trending, err := retrieveTrending(request.Context(), handler.db, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve trending songs: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = sendJSONResponse(rw, http.StatusOK,
+		TrendingResponse{Songs: trending})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// getParametersGlobalTopRequest retrieves and validates parameters to a
+// top artists/songs request across all users. the UserId we return is not
+// used.
+func getParametersGlobalTopRequest(request *http.Request,
+	settings *Config) (*TopParameters, error) {
+	logger := requestLogger(request)
+
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := getLimitParameter(request, int64(settings.TopLimitMax))
+	if err != nil {
+		return nil, err
+	}
+	offset, err := getOffsetParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	daysBack, err := getDaysBackParameter(request)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Parameters: limit [%d] offset [%d] days_back [%d]", limit,
+		offset, daysBack)
+	return &TopParameters{
+		Limit:    limit,
+		Offset:   offset,
+		DaysBack: daysBack,
+	}, nil
+}
+
+// retrieveGlobalTopArtists retrieves the top artist counts across all
+// users. otherwise it is the same as retrieveTopArtists().
+func retrieveGlobalTopArtists(ctx context.Context, db *sql.DB,
+	params *TopParameters) ([]TopResult, int64, error) {
+	defer observeQuery("global_top_artists", time.Now(),
+		fmt.Sprintf("limit [%d]", params.Limit))
+
+	query := `
+SELECT
+COUNT(s.id) AS count,
+s.artist AS label
+FROM play p
+LEFT JOIN song s
+ON p.song_id = s.id
+WHERE
+s.artist != 'N/A'
+AND p.create_time > current_timestamp - CAST($1 AS INTERVAL)
+GROUP BY s.artist
+ORDER BY count DESC
+LIMIT $2
+OFFSET $3
+`
+	interval := daysBackInterval(params.DaysBack)
+
+	results, err := queryTopResults(ctx, db, query, interval, params.Limit,
+		params.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	totalQuery := `
+SELECT COUNT(DISTINCT s.artist)
+FROM play p
+LEFT JOIN song s
+ON p.song_id = s.id
+WHERE
+s.artist != 'N/A'
+AND p.create_time > current_timestamp - CAST($1 AS INTERVAL)
+`
+	var total int64
+	err = db.QueryRowContext(ctx, totalQuery, interval).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
+
+// retrieveGlobalTopSongs retrieves the top song counts across all users.
+// otherwise it is the same as retrieveTopSongs().
+func retrieveGlobalTopSongs(ctx context.Context, db *sql.DB,
+	params *TopParameters) ([]TopResult, int64, error) {
+	defer observeQuery("global_top_songs", time.Now(),
+		fmt.Sprintf("limit [%d]", params.Limit))
+
+	query := `
+SELECT
+COUNT(1) AS count,
+CONCAT(s.artist, ' - ', s.title) AS label
+FROM play p
+LEFT JOIN song s
+ON p.song_id = s.id
+WHERE
+p.create_time > current_timestamp - CAST($1 AS INTERVAL)
+GROUP BY label
+ORDER BY count DESC
+LIMIT $2
+OFFSET $3
+`
+	interval := daysBackInterval(params.DaysBack)
+
+	results, err := queryTopResults(ctx, db, query, interval, params.Limit,
+		params.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	totalQuery := `
+SELECT COUNT(DISTINCT CONCAT(s.artist, ' - ', s.title))
+FROM play p
+LEFT JOIN song s
+ON p.song_id = s.id
+WHERE
+p.create_time > current_timestamp - CAST($1 AS INTERVAL)
+`
+	var total int64
+	err = db.QueryRowContext(ctx, totalQuery, interval).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
+
+// handlerGlobalTopArtists looks up the top artists across all users.
+func handlerGlobalTopArtists(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersGlobalTopRequest(request, handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	// find the counts.
+	counts, total, err := retrieveGlobalTopArtists(request.Context(),
+		handler.db, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top artists: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = responseTopCount(rw, counts, total)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}
+
+// handlerGlobalTopSongs looks up the top songs across all users.
+func handlerGlobalTopSongs(rw http.ResponseWriter, request *http.Request,
+	handler *HttpHandler) {
+	logger := requestLogger(request)
+
+	// find our parameters.
+	params, err := getParametersGlobalTopRequest(request, handler.settings)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve parameters: %s", err.Error())
+		logger.Printf(msg)
+		send400Error(rw, msg)
+		return
+	}
+
+	// find the counts.
+	counts, total, err := retrieveGlobalTopSongs(request.Context(),
+		handler.db, params)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to retrieve top songs: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+
+	// build and send the response.
+	err = responseTopCount(rw, counts, total)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to generate response: %s", err.Error())
+		logger.Printf(msg)
+		send500Error(rw, msg)
+		return
+	}
+}